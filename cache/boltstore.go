@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/willscott/gosendmail/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	entryBucket   = []byte("entries")
+	payloadBucket = []byte("payloads")
+)
+
+// boltOpenTimeout bounds how long to wait for another process using the
+// database.
+const boltOpenTimeout = 30 * time.Second
+
+// BoltStore is a QueueStore keeping the whole queue in a single bolt
+// database file. The database is only held open for the duration of each
+// operation, so that it may be shared between processes. Entries and messages
+// are encrypted if `QueueRecipient` is configured.
+type BoltStore struct {
+	Path string
+}
+
+// boltRecord is the stored form of an entry. The message itself is kept
+// separately in the payload bucket.
+type boltRecord struct {
+	Sender     string
+	Recipients string
+	State
+}
+
+func (s *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(entryBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(payloadBucket); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// view runs `fn` in a read-only transaction, so that reads neither block
+// other readers nor modify the file. `fn` is not called if the database has
+// not been created yet.
+func (s *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(entryBucket) == nil || tx.Bucket(payloadBucket) == nil {
+			return nil
+		}
+		return fn(tx)
+	})
+}
+
+// find resolves a possibly abbreviated ID to a full one.
+func (s *BoltStore) find(tx *bolt.Tx, id string) (string, error) {
+	if id == "" {
+		return "", ErrNotQueued
+	}
+	c := tx.Bucket(entryBucket).Cursor()
+	found := ""
+	for k, _ := c.Seek([]byte(id)); k != nil && bytes.HasPrefix(k, []byte(id)); k, _ = c.Next() {
+		if string(k) == id {
+			return id, nil
+		}
+		if found != "" {
+			return "", fmt.Errorf("message id %s is ambiguous", id)
+		}
+		found = string(k)
+	}
+	if found == "" {
+		return "", fmt.Errorf("%w: %s", ErrNotQueued, id)
+	}
+	return found, nil
+}
+
+func (s *BoltStore) get(tx *bolt.Tx, id string) (*Entry, error) {
+	var rec boltRecord
+	recBytes, err := lib.OpenQueueData(tx.Bucket(entryBucket).Get([]byte(id)))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(recBytes, &rec); err != nil {
+		return nil, err
+	}
+	payload, err := lib.OpenQueueData(tx.Bucket(payloadBucket).Get([]byte(id)))
+	if err != nil {
+		return nil, err
+	}
+	payload = append([]byte{}, payload...)
+	msg := lib.ParseMessage(&payload)
+	msg.ID = id
+	if rec.Sender != "" {
+		msg.SetSender(rec.Sender)
+	}
+	if err := msg.SetRecipients(rec.Recipients); err != nil {
+		return nil, err
+	}
+	return &Entry{Message: msg, State: rec.State}, nil
+}
+
+func (s *BoltStore) put(tx *bolt.Tx, entry *Entry) error {
+	id := []byte(entry.Message.ID)
+	sender := entry.Message.Sender
+	if sender == "" {
+		sender = lib.NullSender
+	}
+	rec, err := json.Marshal(boltRecord{
+		Sender:     sender,
+		Recipients: entry.Message.Recipients(),
+		State:      entry.State,
+	})
+	if err != nil {
+		return err
+	}
+	if rec, err = lib.SealQueueData(rec); err != nil {
+		return err
+	}
+	if tx.Bucket(payloadBucket).Get(id) == nil {
+		payload, err := lib.SealQueueData(*entry.Message.Bytes)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(payloadBucket).Put(id, payload); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(entryBucket).Put(id, rec)
+}
+
+// Put adds or replaces a queued entry.
+func (s *BoltStore) Put(entry Entry) error {
+	if entry.Message.ID == "" {
+		return fmt.Errorf("message has no id")
+	}
+	entry.LeasedUntil = nil
+	return s.update(func(tx *bolt.Tx) error {
+		return s.put(tx, &entry)
+	})
+}
+
+// Get returns a single queued entry.
+func (s *BoltStore) Get(id string) (*Entry, error) {
+	var entry *Entry
+	err := s.view(func(tx *bolt.Tx) error {
+		full, err := s.find(tx, id)
+		if err != nil {
+			return err
+		}
+		entry, err = s.get(tx, full)
+		return err
+	})
+	if err == nil && entry == nil {
+		err = fmt.Errorf("%w: %s", ErrNotQueued, id)
+	}
+	return entry, err
+}
+
+func (s *BoltStore) all(tx *bolt.Tx) (MessageCache, error) {
+	mc := MessageCache{}
+	err := tx.Bucket(entryBucket).ForEach(func(k, _ []byte) error {
+		entry, err := s.get(tx, string(k))
+		if err != nil {
+			return err
+		}
+		mc = append(mc, *entry)
+		return nil
+	})
+	return mc, err
+}
+
+// List returns every queued entry.
+func (s *BoltStore) List() (mc MessageCache, err error) {
+	mc = MessageCache{}
+	err = s.view(func(tx *bolt.Tx) error {
+		mc, err = s.all(tx)
+		return err
+	})
+	return
+}
+
+// UpdateRecipients sets the recipients remaining for a queued message.
+func (s *BoltStore) UpdateRecipients(id string, recipients string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		full, err := s.find(tx, id)
+		if err != nil {
+			return err
+		}
+		entry, err := s.get(tx, full)
+		if err != nil {
+			return err
+		}
+		if err := entry.Message.SetRecipients(recipients); err != nil {
+			return err
+		}
+		return s.put(tx, entry)
+	})
+}
+
+// Delete removes an entry and its message from the queue.
+func (s *BoltStore) Delete(id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		full, err := s.find(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(payloadBucket).Delete([]byte(full)); err != nil {
+			return err
+		}
+		return tx.Bucket(entryBucket).Delete([]byte(full))
+	})
+}
+
+// Lease claims entries for delivery by the caller.
+func (s *BoltStore) Lease(now time.Time, d time.Duration, ids ...string) (leased []Entry, err error) {
+	err = s.update(func(tx *bolt.Tx) error {
+		mc, err := s.all(tx)
+		if err != nil {
+			return err
+		}
+		if leased, err = lease(mc, now, d, ids); err != nil {
+			return err
+		}
+		for i := range leased {
+			if err := s.put(tx, &leased[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
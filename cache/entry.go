@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/lib"
+)
+
+// Default retry schedule for queued messages.
+const (
+	DefaultRetryInterval    = 15 * time.Minute
+	DefaultMaxRetryInterval = 4 * time.Hour
+	DefaultQueueLifetime    = 5 * 24 * time.Hour
+)
+
+// RetryPolicy determines when delivery of a queued message is next attempted,
+// and when the queue gives up on it.
+type RetryPolicy struct {
+	// Interval is the delay before the first retry. It doubles with each
+	// further attempt, up to MaxInterval.
+	Interval    time.Duration
+	MaxInterval time.Duration
+	// Lifetime is how long after first being queued a message is retried.
+	Lifetime time.Duration
+}
+
+// GetRetryPolicy reads the retry schedule from the `RetryInterval`,
+// `MaxRetryInterval` and `QueueLifetime` configuration options.
+func GetRetryPolicy() RetryPolicy {
+	p := RetryPolicy{
+		Interval:    DefaultRetryInterval,
+		MaxInterval: DefaultMaxRetryInterval,
+		Lifetime:    DefaultQueueLifetime,
+	}
+	if d := viper.GetDuration("RetryInterval"); d > 0 {
+		p.Interval = d
+	}
+	if d := viper.GetDuration("MaxRetryInterval"); d > 0 {
+		p.MaxInterval = d
+	}
+	if d := viper.GetDuration("QueueLifetime"); d > 0 {
+		p.Lifetime = d
+	}
+	return p
+}
+
+// Backoff is the delay before the attempt following `attempts` failed ones.
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	d := p.Interval
+	for i := 1; i < attempts && d < p.MaxInterval; i++ {
+		d *= 2
+	}
+	if p.MaxInterval > 0 && d > p.MaxInterval {
+		d = p.MaxInterval
+	}
+	return d
+}
+
+// Entry is a queued message along with the state of its delivery attempts.
+type Entry struct {
+	Message lib.ParsedMessage
+	State
+}
+
+// State is the delivery state of a queued message.
+type State struct {
+	Queued      time.Time
+	Attempts    int
+	LastError   string `json:",omitempty"`
+	NextAttempt time.Time
+	// Dead is set once the message has outlived the queue lifetime. Dead
+	// entries are kept for inspection but no longer retried.
+	Dead bool `json:",omitempty"`
+	// Warned is set once the sender has been told delivery is delayed.
+	Warned bool `json:",omitempty"`
+	// Sent is set once a copy of the message has been stored in the sender's
+	// SentMaildir.
+	Sent bool `json:",omitempty"`
+	// LeasedUntil is set while a worker is attempting delivery of the message.
+	LeasedUntil *time.Time `json:",omitempty"`
+}
+
+// NewEntry creates a queue entry for a message whose first delivery attempt
+// failed with `err`.
+func NewEntry(msg lib.ParsedMessage, err error, now time.Time, policy RetryPolicy) Entry {
+	e := Entry{Message: msg, State: State{Queued: now}}
+	e.Fail(err, now, policy)
+	return e
+}
+
+// Due indicates if delivery of the entry should be attempted at `now`.
+func (e *Entry) Due(now time.Time) bool {
+	return !e.Dead && !now.Before(e.NextAttempt)
+}
+
+// Leased indicates if a worker holds a lease on the entry at `now`.
+func (e *Entry) Leased(now time.Time) bool {
+	return e.LeasedUntil != nil && now.Before(*e.LeasedUntil)
+}
+
+// Fail records a failed delivery attempt and schedules the next one. The entry
+// is marked dead if the next attempt would fall beyond the queue lifetime.
+func (e *Entry) Fail(err error, now time.Time, policy RetryPolicy) {
+	if e.Queued.IsZero() {
+		e.Queued = now
+	}
+	e.Attempts++
+	if err != nil {
+		e.LastError = err.Error()
+	}
+	e.NextAttempt = now.Add(policy.Backoff(e.Attempts))
+	if e.NextAttempt.After(e.Queued.Add(policy.Lifetime)) {
+		e.Dead = true
+	}
+}
+
+// UnmarshalJSON loads an entry, accepting the bare "<hash> <rcpts>" message
+// handles of queues written by earlier versions.
+func (e *Entry) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &e.Message)
+	}
+	type entry Entry
+	return json.Unmarshal(b, (*entry)(e))
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"os"
+	"time"
+)
+
+// FileStore is the default QueueStore, keeping the queue index in
+// inflight.json and each message in its own file alongside the configuration.
+type FileStore struct{}
+
+// Put adds or replaces a queued entry.
+func (FileStore) Put(entry Entry) error {
+	entry.LeasedUntil = nil
+	return Update(func(mc *MessageCache) error {
+		for i := range *mc {
+			if (*mc)[i].Message.ID == entry.Message.ID {
+				(*mc)[i] = entry
+				return nil
+			}
+		}
+		*mc = append(*mc, entry)
+		return nil
+	})
+}
+
+// Get returns a single queued entry.
+func (s FileStore) Get(id string) (*Entry, error) {
+	mc, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	i, err := mc.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return &mc[i], nil
+}
+
+// List returns every queued entry.
+func (FileStore) List() (MessageCache, error) {
+	mc, err := LoadMessageCache()
+	if os.IsNotExist(err) {
+		return MessageCache{}, nil
+	}
+	return mc, err
+}
+
+// UpdateRecipients sets the recipients remaining for a queued message.
+func (FileStore) UpdateRecipients(id string, recipients string) error {
+	return Update(func(mc *MessageCache) error {
+		i, err := mc.Find(id)
+		if err != nil {
+			return err
+		}
+		return (*mc)[i].Message.SetRecipients(recipients)
+	})
+}
+
+// Delete removes an entry and its message file from the queue.
+func (FileStore) Delete(id string) error {
+	return Update(func(mc *MessageCache) error {
+		i, err := mc.Find(id)
+		if err != nil {
+			return err
+		}
+		if err := (*mc)[i].Message.Unlink(); err != nil {
+			return err
+		}
+		*mc = append((*mc)[:i], (*mc)[i+1:]...)
+		return nil
+	})
+}
+
+// Lease claims entries for delivery by the caller.
+func (FileStore) Lease(now time.Time, d time.Duration, ids ...string) ([]Entry, error) {
+	var leased []Entry
+	err := Update(func(mc *MessageCache) error {
+		var err error
+		leased, err = lease(*mc, now, d, ids)
+		return err
+	})
+	return leased, err
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"os"
+	"path"
+)
+
+// Lock is an advisory lock on the queue, shared between signmail processes.
+type Lock struct {
+	f *os.File
+}
+
+func acquire(name string) (*Lock, error) {
+	f, err := os.OpenFile(path.Join(queueDir(), name), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	defer l.f.Close()
+	return unlockFile(l.f)
+}
+
+// lockIndex waits for exclusive access to the queue index and payloads.
+func lockIndex() (*Lock, error) {
+	return acquire("inflight.lock")
+}
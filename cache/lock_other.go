@@ -0,0 +1,16 @@
+//go:build !unix
+
+package cache
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, where concurrent signmail
+// processes are not kept from modifying the queue at once.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -3,8 +3,15 @@ package cache
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/spf13/viper"
 	"github.com/willscott/gosendmail/lib"
@@ -12,13 +19,24 @@ import (
 
 // MessageCache represents the email messages for which a send has been
 // attempted and either failed to a queue or partially sent.
-type MessageCache []lib.ParsedMessage
+type MessageCache []Entry
 
-// Save seralizes the MessageCache to a canonical disk location.
+// queueDir is the directory holding the queue, alongside the config file.
+func queueDir() string {
+	return path.Dir(viper.ConfigFileUsed())
+}
+
+// Save seralizes the MessageCache to a canonical disk location, encrypted if
+// `QueueRecipient` is configured. Message payloads already on disk are not
+// rewritten. Callers sharing the queue with
+// other processes should use Update instead.
 func (m *MessageCache) Save() error {
-	confPath := path.Join(path.Dir(viper.ConfigFileUsed()), "inflight.json")
-	for _, msg := range *m {
-		if err := msg.Save(); err != nil {
+	confPath := path.Join(queueDir(), "inflight.json")
+	for _, entry := range *m {
+		if _, err := os.Stat(entry.Message.FileName()); err == nil {
+			continue
+		}
+		if err := entry.Message.Save(); err != nil {
 			return err
 		}
 	}
@@ -28,12 +46,16 @@ func (m *MessageCache) Save() error {
 	}
 	var out bytes.Buffer
 	json.Indent(&out, b, "", "  ")
-	return os.WriteFile(confPath, out.Bytes(), 0600)
+	sealed, err := lib.SealQueueData(out.Bytes())
+	if err != nil {
+		return err
+	}
+	return lib.WriteFileAtomic(confPath, sealed)
 }
 
 // Unlink deletes the message cache from disk
 func (m *MessageCache) Unlink() error {
-	confPath := path.Join(path.Dir(viper.ConfigFileUsed()), "inflight.json")
+	confPath := path.Join(queueDir(), "inflight.json")
 	if _, err := os.Stat(confPath); os.IsNotExist(err) {
 		return nil
 	}
@@ -41,16 +63,140 @@ func (m *MessageCache) Unlink() error {
 }
 
 // LoadMessageCache attempts to load in-flight messages from their canonical
-// disk location.
+// disk location. Entries whose payload is missing are dropped.
 func LoadMessageCache() (MessageCache, error) {
-	confPath := path.Join(path.Dir(viper.ConfigFileUsed()), "inflight.json")
+	confPath := path.Join(queueDir(), "inflight.json")
 	bytes, err := os.ReadFile(confPath)
 	if err != nil {
 		return nil, err
 	}
-	cache := new(MessageCache)
-	if err = json.Unmarshal(bytes, cache); err != nil {
+	if bytes, err = lib.OpenQueueData(bytes); err != nil {
 		return nil, err
 	}
-	return *cache, nil
+	raw := make([]json.RawMessage, 0)
+	if err = json.Unmarshal(bytes, &raw); err != nil {
+		return nil, err
+	}
+	cache := make(MessageCache, 0, len(raw))
+	for _, r := range raw {
+		var entry Entry
+		if err := json.Unmarshal(r, &entry); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Dropping queue entry with missing payload: %v", err)
+				continue
+			}
+			return nil, err
+		}
+		cache = append(cache, entry)
+	}
+	return cache, nil
+}
+
+// Update applies `fn` to the queue while holding its lock, and saves the
+// result, so that concurrent signmail processes do not lose each other's
+// changes. Interrupted writes from earlier processes are cleaned up first.
+func Update(fn func(*MessageCache) error) error {
+	l, err := lockIndex()
+	if err != nil {
+		return err
+	}
+	defer l.Unlock()
+
+	mc, err := LoadMessageCache()
+	switch {
+	case err == nil:
+		err = Recover(mc)
+	case os.IsNotExist(err):
+		// Without an index there is nothing to tell queued payloads from
+		// orphaned ones, so only temporary files are cleaned up.
+		err = removeTemporaries()
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(&mc); err != nil {
+		return err
+	}
+	return mc.Save()
+}
+
+// payloadName matches the file names given to queued messages, named by their
+// ID or, for those queued by earlier versions, their hash. Other files sharing
+// the config directory are left alone.
+var payloadName = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{64})\.eml$`)
+
+// Recover reconciles the queue directory with the loaded index `mc`. Temporary
+// files left by interrupted writes are removed, and message payloads which are
+// not referenced by the index are moved to an `orphaned` directory for manual
+// inspection. It must be called with the queue locked, and only with an index
+// which was loaded successfully.
+func Recover(mc MessageCache) error {
+	if err := removeTemporaries(); err != nil {
+		return err
+	}
+
+	dir := queueDir()
+	referenced := make(map[string]bool, len(mc))
+	for _, entry := range mc {
+		referenced[entry.Message.FileName()] = true
+	}
+	payloads, err := filepath.Glob(path.Join(dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		if referenced[p] || !payloadName.MatchString(path.Base(p)) {
+			continue
+		}
+		orphans := path.Join(dir, "orphaned")
+		if err := os.MkdirAll(orphans, 0700); err != nil {
+			return err
+		}
+		log.Printf("Moving unqueued message %s to %s", path.Base(p), orphans)
+		if err := os.Rename(p, path.Join(orphans, path.Base(p))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTemporaries deletes the temporary files left by interrupted writes to
+// the queue directory.
+func removeTemporaries() error {
+	for _, pattern := range []string{".inflight.json.tmp*", ".*.eml.tmp*"} {
+		temps, err := filepath.Glob(path.Join(queueDir(), pattern))
+		if err != nil {
+			return err
+		}
+		for _, t := range temps {
+			if err := os.Remove(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrNotQueued is returned by Find when no queued message has the given ID.
+var ErrNotQueued = errors.New("no such message in queue")
+
+// Find returns the index of the queued message with the given ID, which may
+// be abbreviated to any unique prefix.
+func (m MessageCache) Find(id string) (int, error) {
+	found := -1
+	for i, entry := range m {
+		if entry.Message.ID == id {
+			return i, nil
+		}
+		if id != "" && strings.HasPrefix(entry.Message.ID, id) {
+			if found != -1 {
+				return -1, fmt.Errorf("message id %s is ambiguous", id)
+			}
+			found = i
+		}
+	}
+	if found == -1 {
+		return -1, fmt.Errorf("%w: %s", ErrNotQueued, id)
+	}
+	return found, nil
 }
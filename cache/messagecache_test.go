@@ -1,9 +1,15 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/willscott/gosendmail/lib"
@@ -20,7 +26,7 @@ func TestMessageCache(t *testing.T) {
 
 	msg := lib.ParseMessage(&content)
 
-	cache := MessageCache{msg}
+	cache := MessageCache{NewEntry(msg, nil, time.Now(), GetRetryPolicy())}
 	if err = cache.Save(); err != nil {
 		t.Fatal(err)
 	}
@@ -29,10 +35,209 @@ func TestMessageCache(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(newCache) != 1 || strings.Compare(newCache[0].Recipients(), msg.Recipients()) != 0 {
+	if len(newCache) != 1 || strings.Compare(newCache[0].Message.Recipients(), msg.Recipients()) != 0 {
 		t.Fatalf("cache not durable")
 	}
+	if newCache[0].Attempts != 1 || !newCache[0].NextAttempt.Equal(cache[0].NextAttempt) {
+		t.Fatalf("retry state not durable: %+v", newCache[0])
+	}
 
-	newCache[0].Unlink()
+	newCache[0].Message.Unlink()
 	newCache.Unlink()
 }
+
+func TestLegacyMessageCache(t *testing.T) {
+	content, err := os.ReadFile("../lib/testdata/test.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(t.TempDir())
+	msg := lib.ParseMessage(&content)
+	msg.ID = msg.Hash()
+	if err := msg.Save(); err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Unlink()
+
+	legacy := `["` + msg.Hash() + ` will@gmail.com"]`
+	confPath := path.Join(path.Dir(viper.ConfigFileUsed()), "inflight.json")
+	if err := os.WriteFile(confPath, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mc, err := LoadMessageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc) != 1 || mc[0].Message.Recipients() != "will@gmail.com" || mc[0].Message.ID != msg.Hash() {
+		t.Fatalf("legacy entry not loaded: %+v", mc)
+	}
+	if !mc[0].Due(time.Now()) {
+		t.Fatal("legacy entry should be due immediately")
+	}
+
+	// saving migrates the index to the current format, keeping the payload.
+	if err := mc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	mc, err = LoadMessageCache()
+	if err != nil || len(mc) != 1 || mc[0].Message.ID != msg.Hash() {
+		t.Fatalf("migrated entry not loaded: %v %+v", err, mc)
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	policy := RetryPolicy{Interval: time.Minute, MaxInterval: 10 * time.Minute, Lifetime: time.Hour}
+	for attempts, expected := range map[int]time.Duration{
+		1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 5: 10 * time.Minute, 50: 10 * time.Minute,
+	} {
+		if d := policy.Backoff(attempts); d != expected {
+			t.Fatalf("backoff after %d attempts was %v, expected %v", attempts, d, expected)
+		}
+	}
+
+	start := time.Now()
+	e := Entry{State: State{Queued: start}}
+	now := start
+	for !e.Dead {
+		if !e.Due(now) {
+			t.Fatal("entry should be due at its next attempt time")
+		}
+		e.Fail(errors.New("unreachable"), now, policy)
+		if e.Due(now) {
+			t.Fatal("entry should not be due again immediately")
+		}
+		now = e.NextAttempt
+	}
+	if e.LastError != "unreachable" || e.Attempts != 9 {
+		t.Fatalf("unexpected state after expiry: %+v", e)
+	}
+	if e.Due(now.Add(time.Hour)) {
+		t.Fatal("dead entries should not be retried")
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	viper.SetConfigFile(path.Join(t.TempDir(), "config.json"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := []byte(fmt.Sprintf("From: a@example.com\r\nTo: b@example.com\r\n\r\nmessage %d\r\n", i))
+			msg := lib.ParseMessage(&content)
+			err := Update(func(mc *MessageCache) error {
+				*mc = append(*mc, NewEntry(msg, nil, time.Now(), GetRetryPolicy()))
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mc, err := LoadMessageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc) != 10 {
+		t.Fatalf("expected 10 queued messages, found %d", len(mc))
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	viper.SetConfigFile(path.Join(dir, "config.json"))
+
+	content := []byte("From: a@example.com\r\nTo: b@example.com\r\n\r\nqueued\r\n")
+	msg := lib.ParseMessage(&content)
+	orphanContent := []byte("From: a@example.com\r\nTo: b@example.com\r\n\r\norphan\r\n")
+	orphan := lib.ParseMessage(&orphanContent)
+	if err := orphan.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".inflight.json.tmp123", "." + orphan.ID + ".eml.tmp456", "unrelated.eml"} {
+		if err := os.WriteFile(path.Join(dir, name), []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := Update(func(mc *MessageCache) error {
+		*mc = append(*mc, NewEntry(msg, nil, time.Now(), GetRetryPolicy()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without an index to compare against, no payload is treated as orphaned.
+	if _, err := os.Stat(orphan.FileName()); err != nil {
+		t.Fatalf("payload moved without an index: %v", err)
+	}
+	if err := Update(func(*MessageCache) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(path.Join(dir, "*"))
+	hidden, _ := filepath.Glob(path.Join(dir, ".*"))
+	names := make([]string, 0)
+	for _, f := range append(files, hidden...) {
+		names = append(names, path.Base(f))
+	}
+	if _, err := os.Stat(path.Join(dir, "orphaned", orphan.ID+".eml")); err != nil {
+		t.Fatalf("orphaned payload not quarantined: %v", names)
+	}
+	if len(hidden) != 0 {
+		t.Fatalf("temporary files not removed: %v", names)
+	}
+	if _, err := os.Stat(path.Join(dir, "unrelated.eml")); err != nil {
+		t.Fatalf("unrelated file disturbed: %v", names)
+	}
+	if _, err := os.Stat(msg.FileName()); err != nil {
+		t.Fatalf("queued payload missing: %v", names)
+	}
+}
+
+func TestIdenticalBodies(t *testing.T) {
+	viper.SetConfigFile(path.Join(t.TempDir(), "config.json"))
+
+	a := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: one\r\n\r\n+1\r\n")
+	b := []byte("From: a@example.com\r\nTo: c@example.com\r\nSubject: two\r\n\r\n+1\r\n")
+	msgA, msgB := lib.ParseMessage(&a), lib.ParseMessage(&b)
+	if msgA.Hash() != msgB.Hash() || msgA.ID == msgB.ID {
+		t.Fatal("expected distinct ids for messages with identical bodies")
+	}
+	mc := MessageCache{NewEntry(msgA, nil, time.Now(), GetRetryPolicy()), NewEntry(msgB, nil, time.Now(), GetRetryPolicy())}
+	if err := mc.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc[0].Message.Unlink(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMessageCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0].Message.ID != msgB.ID || loaded[0].Message.Recipients() != "c@example.com" {
+		t.Fatalf("removing one message affected the other: %+v", loaded)
+	}
+}
+
+func TestFind(t *testing.T) {
+	mc := MessageCache{
+		{Message: lib.ParsedMessage{ID: "abc123"}},
+		{Message: lib.ParsedMessage{ID: "abd456"}},
+		{Message: lib.ParsedMessage{ID: "abc"}},
+	}
+	for id, expected := range map[string]int{"abc123": 0, "abd": 1, "abc": 2, "abc1": 0} {
+		if i, err := mc.Find(id); err != nil || i != expected {
+			t.Fatalf("find %s: got %d, %v; expected %d", id, i, err, expected)
+		}
+	}
+	if _, err := mc.Find("ab"); err == nil {
+		t.Fatal("expected ambiguous prefix to fail")
+	}
+	if _, err := mc.Find("ff"); !errors.Is(err, ErrNotQueued) {
+		t.Fatalf("expected missing id to fail with ErrNotQueued, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// QueueStore holds queued messages along with the state of their delivery.
+// Messages are identified by their ID, which may be abbreviated to a unique
+// prefix when looking them up.
+type QueueStore interface {
+	// Put adds an entry to the queue, or replaces the entry with the same ID.
+	// Any lease on the entry is released.
+	Put(entry Entry) error
+	// Get returns a single queued entry.
+	Get(id string) (*Entry, error)
+	// List returns every queued entry.
+	List() (MessageCache, error)
+	// UpdateRecipients sets the recipients remaining for a queued message,
+	// given in AddressList format.
+	UpdateRecipients(id string, recipients string) error
+	// Delete removes an entry and its message from the queue.
+	Delete(id string) error
+	// Lease claims entries for delivery by the caller until `now` + `d`, after
+	// which they may be claimed again if the caller has not `Put` or `Delete`d
+	// them. If `ids` are given those entries are claimed whether or not they
+	// are due, and ErrLeased is returned if any is leased by another worker;
+	// otherwise every due entry which is not already leased is.
+	Lease(now time.Time, d time.Duration, ids ...string) ([]Entry, error)
+}
+
+// OpenStore returns the queue store selected by the `QueueBackend`
+// configuration option: `file` (the default) for inflight.json and message
+// files alongside the configuration, or `bolt` for a single database file,
+// `queue.db`.
+func OpenStore() (QueueStore, error) {
+	switch backend := viper.GetString("QueueBackend"); backend {
+	case "", "file":
+		return FileStore{}, nil
+	case "bolt":
+		return &BoltStore{Path: path.Join(queueDir(), "queue.db")}, nil
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", backend)
+	}
+}
+
+// ErrLeased is returned by Lease when a message asked for by ID is already
+// being delivered by another process.
+var ErrLeased = errors.New("message is being delivered by another process")
+
+// lease marks the entries of `mc` selected for a Lease call as leased, and
+// returns copies of them.
+func lease(mc MessageCache, now time.Time, d time.Duration, ids []string) ([]Entry, error) {
+	selected := make([]int, 0)
+	if len(ids) > 0 {
+		for _, id := range ids {
+			i, err := mc.Find(id)
+			if err != nil {
+				return nil, err
+			}
+			if mc[i].Leased(now) {
+				return nil, fmt.Errorf("%w: %s", ErrLeased, mc[i].Message.ID)
+			}
+			selected = append(selected, i)
+		}
+	} else {
+		for i := range mc {
+			if mc[i].Due(now) && !mc[i].Leased(now) {
+				selected = append(selected, i)
+			}
+		}
+	}
+
+	until := now.Add(d)
+	leased := make([]Entry, 0, len(selected))
+	for _, i := range selected {
+		mc[i].LeasedUntil = &until
+		leased = append(leased, mc[i])
+	}
+	return leased, nil
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/lib"
+)
+
+func testStore(t *testing.T, store QueueStore) {
+	content := []byte("From: a@example.com\r\nTo: b@example.com, c@example.org\r\nSubject: test\r\n\r\nbody\r\n")
+	msg := lib.ParseMessage(&content)
+	now := time.Now()
+	policy := RetryPolicy{Interval: time.Minute, MaxInterval: time.Hour, Lifetime: 24 * time.Hour}
+	entry := NewEntry(msg, errors.New("unreachable"), now, policy)
+	if err := store.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(msg.ID[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Message.ID != msg.ID || got.Attempts != 1 || got.LastError != "unreachable" || string(*got.Message.Bytes) != string(content) {
+		t.Fatalf("entry not stored faithfully: %+v", got)
+	}
+	if _, err := store.Get("ffff"); !errors.Is(err, ErrNotQueued) {
+		t.Fatalf("expected missing entry to fail with ErrNotQueued, got %v", err)
+	}
+
+	if err := store.UpdateRecipients(msg.ID, "c@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	mc, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc) != 1 || mc[0].Message.Recipients() != "c@example.org" {
+		t.Fatalf("recipients not updated: %+v", mc)
+	}
+
+	// nothing is due until the retry interval passes.
+	if leased, err := store.Lease(now, time.Hour); err != nil || len(leased) != 0 {
+		t.Fatalf("leased entries before due: %v, %v", leased, err)
+	}
+	later := now.Add(2 * time.Minute)
+	leased, err := store.Lease(later, time.Hour)
+	if err != nil || len(leased) != 1 {
+		t.Fatalf("expected due entry to be leased: %v, %v", leased, err)
+	}
+	if again, err := store.Lease(later, time.Hour); err != nil || len(again) != 0 {
+		t.Fatalf("leased entry claimed twice: %v, %v", again, err)
+	}
+	if again, err := store.Lease(later, time.Hour, msg.ID); !errors.Is(err, ErrLeased) || len(again) != 0 {
+		t.Fatalf("expected leased entry asked for by id to fail with ErrLeased, got %v, %v", again, err)
+	}
+	if again, err := store.Lease(later.Add(2*time.Hour), time.Hour); err != nil || len(again) != 1 {
+		t.Fatalf("expired lease not reclaimed: %v, %v", again, err)
+	}
+
+	// putting an entry back releases its lease.
+	leased[0].Fail(errors.New("still unreachable"), later, policy)
+	if err := store.Put(leased[0]); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Get(msg.ID)
+	if err != nil || got.Leased(later) || got.Attempts != 2 {
+		t.Fatalf("entry not updated: %+v, %v", got, err)
+	}
+
+	if err := store.Delete(msg.ID); err != nil {
+		t.Fatal(err)
+	}
+	if mc, err := store.List(); err != nil || len(mc) != 0 {
+		t.Fatalf("entry not deleted: %v, %v", mc, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	viper.SetConfigFile(path.Join(t.TempDir(), "config.json"))
+	testStore(t, FileStore{})
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, &BoltStore{Path: path.Join(t.TempDir(), "queue.db")})
+}
+
+func TestEncryptedStores(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFile := path.Join(dir, "queue.key")
+	if err := os.WriteFile(keyFile, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer viper.Reset()
+
+	viper.SetConfigFile(path.Join(dir, "config.json"))
+	viper.Set("QueueRecipient", id.Recipient().String())
+	viper.Set("QueueIdentityCmd", "cat "+keyFile)
+	testStore(t, FileStore{})
+
+	content := []byte("From: a@example.com\r\nTo: b@example.com\r\n\r\nsecret\r\n")
+	msg := lib.ParseMessage(&content)
+	if err := (FileStore{}).Put(Entry{Message: msg}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{path.Join(dir, "inflight.json"), msg.FileName()} {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lib.IsSealed(data) {
+			t.Fatalf("%s not encrypted", f)
+		}
+	}
+
+	bolt := &BoltStore{Path: path.Join(dir, "queue.db")}
+	testStore(t, bolt)
+	if err := bolt.Put(Entry{Message: msg}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(bolt.Path)
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("b@example.com")) {
+		t.Fatal("queue database not encrypted")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/3th1nk/cidr"
 	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/lib"
 )
 
 var (
@@ -173,12 +175,45 @@ var Processor = func() backends.Decorator {
 						destList = "" + dest.String()
 					}
 				}
-				child.Env = []string{"GOSENDMAIL_FROM=" + e.MailFrom.String(), "GOSENDMAIL_RECIPIENTS=" + destList}
-				out, err := child.CombinedOutput()
-				if err != nil {
-					mainlog.WithError(fmt.Errorf("sendmail err %w: %s", err, out)).Errorf("Failed to send mail")
+				from := e.MailFrom.String()
+				if e.MailFrom.IsEmpty() {
+					from = lib.NullSender
+				}
+				child.Env = []string{"GOSENDMAIL_FROM=" + from, "GOSENDMAIL_RECIPIENTS=" + destList,
+					"GOSENDMAIL_FORMAT=json"}
+				var stdout, stderr bytes.Buffer
+				child.Stdout = &stdout
+				child.Stderr = &stderr
+				err := child.Run()
+
+				// Work out which recipients the message reached.
+				data := e.Data.Bytes()
+				parsed := lib.ParsedMessage{Bytes: &data}
+				parsed.SetRecipients(destList)
+				total := len(parsed.RecipientMap())
+				if !lib.InterpretEvents(stdout.String(), &parsed) {
+					lib.InterpretLog(stdout.String()+stderr.String(), &parsed)
+				}
+				undelivered := parsed.RecipientMap()
+				delivered := total - len(undelivered) - len(parsed.Rejected)
+				if len(undelivered) == 0 && len(parsed.Rejected) == 0 {
+					return backends.NewResult("250 2.0.0 OK: queued", 250), nil
+				}
+				if delivered <= 0 {
+					mainlog.WithError(fmt.Errorf("sendmail err %v: %s%s", err, stdout.String(), stderr.String())).Errorf("Failed to send mail")
+					if len(parsed.Rejected) == 0 && len(parsed.Deferred) > 0 {
+						return backends.NewResult("451 4.4.0 Failed to send mail, try again later", 451), nil
+					}
 					return backends.NewResult("550 5.7.1 Failed to send mail", 550), nil
 				}
+
+				// The message was accepted for some recipients, so the
+				// failures for the others are reported back to the sender.
+				if e.MailFrom.IsEmpty() {
+					mainlog.Infof("Not reporting failed recipients of a bounce: %v", undelivered)
+				} else if err := reportFailures(&parsed, e.MailFrom.String(), undelivered); err != nil {
+					mainlog.WithError(err).Errorf("Failed to deliver status notification")
+				}
 				return backends.NewResult("250 2.0.0 OK: queued", 250), nil
 			}
 			return c.Process(e, task)
@@ -186,6 +221,34 @@ var Processor = func() backends.Decorator {
 	}
 }
 
+// reportFailures notifies `sender` of recipients of a relayed message which
+// were rejected, or which remain undelivered, via the configured DSNMaildir or
+// DSNCommand. Rejected recipients are reported as failed, while those still
+// pending are reported as delayed, as a send command such as signmail queues
+// them to be retried.
+func reportFailures(parsed *lib.ParsedMessage, sender string, undelivered map[string]bool) error {
+	if err := parsed.SetSender(sender); err != nil {
+		return err
+	}
+	failed := lib.NewDSNRecipients(parsed.Rejected, lib.ActionFailed, "5.0.0")
+	pending := make(map[string]string)
+	for rcpt := range undelivered {
+		if reply, ok := parsed.Deferred[rcpt]; ok {
+			pending[rcpt] = reply
+		} else {
+			pending[rcpt] = "not delivered"
+		}
+	}
+	failed = append(failed, lib.NewDSNRecipients(pending, lib.ActionDelayed, "4.0.0")...)
+	host, _ := os.Hostname()
+	dsn := lib.DSN{ReportingMTA: host, Message: parsed, Arrival: time.Now(), Recipients: failed}
+	notice, err := dsn.Bytes(time.Now())
+	if err != nil {
+		return err
+	}
+	return lib.DeliverNotice(notice)
+}
+
 func getFileLimit() int {
 	cmd := exec.Command("ulimit", "-n")
 	out, err := cmd.Output()
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"path"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/willscott/gosendmail/lib"
@@ -13,20 +15,35 @@ import (
 // Sendmail negotiates a series of SMTP connections with remote servers
 // to deliver a message sent on stdin. It is stateless.
 //
-// The output (log.Fatalf / log.Printf) from this process are parsed
+// When GOSENDMAIL_FORMAT=json is set, progress is written to stdout as
+// newline-delimited JSON events (see lib/event.go), which are preferred
+// by the signmail commanding process.
+//
+// Otherwise, the output (log.Fatalf / log.Printf) from this process is parsed
 // by lib/log.go in the signmail commanding process.
-// The expected convention is that lines follow one of three formats:
+// The expected convention is that lines follow one of these formats:
 // * "Info: " - ignored
 // * "Delivered: <recipients>" - indication of successful delivery
+// * "Rejected: <recipient>: <reply>" - permanent failure for a recipient
+// * "Deferred: <recipient>: <reply>" - temporary failure for a recipient
+// * "Failed: <error>" - indication that delivery to a domain failed
 // * "Fatal: " - indication that an error occured
+//
+// Delivery to each destination domain is attempted even if earlier
+// domains fail; the process exits non-zero if any recipient failed.
 func main() {
 	// get config
 	viper.AddConfigPath("$HOME/.gosendmail")
 	viper.AddConfigPath(".")
 	viper.SetDefault("tls", true)
 	viper.SetDefault("selfsigned", false)
+	viper.SetDefault("mtasts", true)
+	viper.SetDefault("dane", false)
+	viper.SetDefault("daneresolver", "")
+	viper.SetDefault("tlsrpt", true)
 	viper.SetDefault("recipients", "")
 	viper.SetDefault("sender", "")
+	viper.SetDefault("format", "text")
 	viper.SetEnvPrefix("gosendmail")
 	viper.AutomaticEnv()
 	err := viper.ReadInConfig()
@@ -34,6 +51,8 @@ func main() {
 		log.Fatal(err)
 	}
 
+	report := newReporter(viper.GetString("format"))
+
 	// get mail as input
 	msg := lib.ReadMessage(os.Stdin)
 
@@ -43,12 +62,12 @@ func main() {
 	// Set explicit sender if specified
 	if explicitFrom := viper.GetString("sender"); explicitFrom != "" {
 		if err := parsed.SetSender(explicitFrom); err != nil {
-			log.Fatalf("Fatal: %v\n", err)
+			report.fatalf("%v", err)
 		}
 	}
 	cfg := lib.GetConfig(parsed.SourceDomain)
 	if cfg == nil {
-		log.Fatalf("Fatal: No configuration for sender %s\n", parsed.SourceDomain)
+		report.fatalf("No configuration for sender %s", parsed.SourceDomain)
 	}
 
 	rcptOverride := viper.GetString("recipients")
@@ -56,66 +75,83 @@ func main() {
 		parsed.SetRecipients(rcptOverride)
 	}
 
-	for _, dest := range parsed.DestDomain {
-		log.Printf("Info: connecting to %s\n", dest)
-		SendTo(dest, &parsed, cfg, msg, viper.GetBool("tls"), viper.GetBool("selfsigned"))
-	}
-	log.Printf("Info: finished\n")
-}
-
-func SendTo(dest string, parsed *lib.ParsedMessage, cfg *lib.Config, msg []byte, tls bool, selfSigned bool) {
-	// enumerate possible mx IPs
-	hosts := lib.FindServers(dest)
-
-	// open connection
-	conn, hostname := lib.DialFromList(hosts, cfg)
-	helloSrc := parsed.SourceDomain
-	if len(cfg.SourceHost) > 0 {
-		helloSrc = cfg.SourceHost
-	}
-	if err := conn.Hello(helloSrc); err != nil {
-		log.Fatalf("Fatal: negotiating hello with %s: %v", hostname, err)
+	sts := &lib.STSPolicies{
+		Fetcher: &lib.HTTPSTSFetcher{},
+		Cache:   &lib.FileSTSCache{Path: path.Join(path.Dir(viper.ConfigFileUsed()), "mta-sts.json")},
 	}
+	sessions := &lib.TLSSessionStore{Path: path.Join(path.Dir(viper.ConfigFileUsed()), "tlsrpt.jsonl")}
 
-	// try ssl upgrade
-	if tls {
-		if err := lib.StartTLS(conn, hostname, cfg, selfSigned); err != nil {
-			log.Fatalf("Fatal: negotiating starttls with %s: %v", hostname, err)
+	failures := 0
+	for _, dest := range parsed.DestDomain {
+		policy, err := lib.GetTLSPolicy(dest)
+		if err == nil && policy == nil {
+			policy, err = defaultTLSPolicy()
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid tls policy: %w", err)
+			for _, ev := range lib.ResultEvents(parsed.Rcpt[dest], &lib.DeliveryResult{Domain: dest}, err) {
+				report.emit(ev)
+			}
+			failures += len(parsed.Rcpt[dest])
+			continue
+		}
+		opts := lib.SendOptions{TLS: *policy}
+		if viper.GetBool("dane") || policy.Mode == lib.TLSModeDANE {
+			opts.DANE = &lib.DNSSECResolver{Server: viper.GetString("daneresolver")}
+		}
+		var stsErr error
+		if viper.GetBool("mtasts") {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			opts.STS, stsErr = sts.Lookup(ctx, dest)
+			cancel()
+			if stsErr != nil {
+				log.Printf("Info: failed to fetch mta-sts policy for %s: %v\n", dest, stsErr)
+			}
 		}
-	}
-
-	// send email
-	if err := conn.Mail(parsed.Sender); err != nil {
-		log.Fatalf("Fatal: setting mailfrom: %v\n", err)
-	}
 
-	rcpts := ""
-	for _, rcpt := range parsed.Rcpt[dest] {
-		if err := conn.Rcpt(rcpt); err != nil {
-			log.Fatalf("Fatal: setting rcpt %s: %v\n", rcpt, err)
+		log.Printf("Info: connecting to %s\n", dest)
+		result, err := lib.SendTo(dest, &parsed, cfg, opts)
+		if viper.GetBool("tlsrpt") {
+			if session, ok := lib.NewTLSSession(opts, result, err, stsErr); ok {
+				if err := sessions.Append(session); err != nil {
+					log.Printf("Info: failed to record tls session: %v\n", err)
+				}
+			}
+		}
+		for _, violation := range result.Violations {
+			log.Printf("Info: tls issue delivering to %s: %s\n", dest, violation)
 		}
-		if rcpts != "" {
-			rcpts = rcpts + ", "
+		for _, ev := range lib.ResultEvents(parsed.Rcpt[dest], result, err) {
+			report.emit(ev)
+			if ev.Event == lib.EventDeferred || ev.Event == lib.EventRcptRejected {
+				failures++
+			}
 		}
-		rcpts = rcpts + rcpt
 	}
-
-	// Send the email body.
-	wc, err := conn.Data()
-	if err != nil {
-		log.Fatalf("Fatal: sending data: %v\n", err)
+	if failures > 0 {
+		report.fatalf("delivery failed for %d recipients", failures)
 	}
+	log.Printf("Info: finished\n")
+}
 
-	if _, err := io.Copy(wc, bytes.NewReader(msg)); err != nil {
-		log.Fatalf("Fatal: copying bytes of body: %v\n", err)
+// defaultTLSPolicy derives the policy for destinations without an entry in the
+// TLSPolicy table from the `tlsmode` setting, along with the older `tls` and
+// `selfsigned` settings. Without a `tlsmode`, StartTLS is required as it was
+// before modes existed, with a verified certificate unless `selfsigned` is set.
+func defaultTLSPolicy() (*lib.TLSPolicy, error) {
+	if !viper.GetBool("tls") {
+		return &lib.TLSPolicy{Mode: lib.TLSModeNone}, nil
+	}
+	mode := viper.GetString("tlsmode")
+	if mode == "" {
+		mode = lib.TLSModeVerify
 	}
-	err = wc.Close()
+	policy, err := lib.ParseTLSPolicy(map[string]interface{}{"mode": mode})
 	if err != nil {
-		log.Fatalf("Fatal: concluding data: %v\n", err)
+		return nil, err
 	}
-
-	log.Printf("Delivered: %s\n", rcpts)
-
-	// Send the QUIT command and close the connection.
-	conn.Quit()
+	if viper.GetBool("selfsigned") && policy.Mode == lib.TLSModeVerify {
+		policy.Mode = lib.TLSModeEncrypt
+	}
+	return policy, nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/willscott/gosendmail/lib"
+)
+
+// reporter writes delivery events in the format requested by the commanding
+// process: newline-delimited JSON on stdout, or the log-line text protocol.
+type reporter struct {
+	json *json.Encoder
+}
+
+func newReporter(format string) *reporter {
+	if strings.EqualFold(format, "json") {
+		return &reporter{json: json.NewEncoder(os.Stdout)}
+	}
+	return &reporter{}
+}
+
+func (r *reporter) emit(ev lib.Event) {
+	if r.json != nil {
+		r.json.Encode(ev)
+	}
+
+	switch ev.Event {
+	case lib.EventConnect:
+		log.Printf("Info: connected to %s (%s)\n", ev.Host, ev.Addr)
+	case lib.EventTLS:
+		log.Printf("Info: negotiated %s %s with %s\n", ev.TLSVersion, ev.Cipher, ev.Host)
+	case lib.EventDelivered:
+		if !ev.Encrypted {
+			log.Printf("Info: delivered to %s without encryption\n", ev.Host)
+		}
+		if r.json == nil {
+			log.Printf("Delivered: %s\n", strings.Join(ev.Recipients, ", "))
+		} else {
+			log.Printf("Info: delivered to %s\n", strings.Join(ev.Recipients, ", "))
+		}
+	case lib.EventRcptRejected:
+		if r.json == nil {
+			log.Printf("Rejected: %s: %s\n", ev.Recipient, ev.Reply)
+		} else {
+			log.Printf("Info: %s rejected: %s\n", ev.Recipient, ev.Reply)
+		}
+	case lib.EventDeferred:
+		if r.json == nil {
+			log.Printf("Deferred: %s: %s\n", ev.Recipient, ev.Reply)
+		} else {
+			log.Printf("Info: %s deferred: %s\n", ev.Recipient, ev.Reply)
+		}
+	case lib.EventFailed:
+		if r.json == nil {
+			log.Printf("Failed: %s at %s: %s\n", ev.Domain, ev.Stage, ev.Reply)
+		} else {
+			log.Printf("Info: %s failed at %s: %s\n", ev.Domain, ev.Stage, ev.Reply)
+		}
+	}
+}
+
+// fatalf reports an error preventing any further delivery and exits.
+func (r *reporter) fatalf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if r.json != nil {
+		r.json.Encode(lib.Event{Event: lib.EventFailed, Reply: msg})
+	}
+	log.Fatalf("Fatal: %s\n", msg)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/lib"
+)
+
+// agentSocket is the unix socket of the DKIM key agent, configured by
+// `DkimAgentSocket` and otherwise kept in a private directory alongside the
+// configuration.
+func agentSocket() string {
+	if p := viper.GetString("DkimAgentSocket"); p != "" {
+		return p
+	}
+	return path.Join(path.Dir(viper.ConfigFileUsed()), "dkim-agent", "agent.sock")
+}
+
+// configureKeyAgent has messages signed through the key agent, starting it
+// when needed, if `DkimAgentTimeout` is set.
+func configureKeyAgent() {
+	if viper.GetDuration("DkimAgentTimeout") <= 0 {
+		lib.KeyAgent = nil
+		return
+	}
+	lib.KeyAgent = &lib.KeyAgentClient{Path: agentSocket(), Start: startKeyAgent}
+}
+
+// flushKeyAgent has a running key agent forget its keys, so that keys rotated
+// along with the configuration are read again.
+func flushKeyAgent() {
+	if lib.KeyAgent == nil {
+		return
+	}
+	if err := lib.KeyAgent.Flush(); err != nil {
+		log.Printf("Failed to flush key agent: %v", err)
+	}
+}
+
+// startKeyAgent launches `signmail --dkim-agent` in the background, detached
+// from this process so that it outlives it.
+func startKeyAgent() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "--dkim-agent")
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// runKeyAgent serves the key agent until it has been idle for
+// `DkimAgentTimeout`.
+func runKeyAgent() {
+	l, err := lib.ListenKeyAgent(agentSocket())
+	if errors.Is(err, lib.ErrAgentRunning) {
+		return
+	} else if err != nil {
+		log.Fatalf("Failed to start key agent: %v", err)
+	}
+	agent := &lib.KeyAgentServer{Idle: viper.GetDuration("DkimAgentTimeout")}
+	if err := agent.Serve(l); err != nil {
+		log.Fatalf("Key agent failed: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// detach leaves `cmd` as it is on platforms without sessions.
+func detach(cmd *exec.Cmd) {}
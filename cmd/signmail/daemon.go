@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/cache"
+)
+
+// pollInterval bounds how long the daemon sleeps between queue flushes.
+const pollInterval = 5 * time.Minute
+
+// settleDelay lets a burst of writes to the queue finish before it is flushed.
+const settleDelay = time.Second
+
+// runDaemon delivers queued messages as they become due until terminated.
+// The queue is flushed on a timer and whenever another signmail process adds
+// to it. SIGHUP reloads the configuration, and SIGTERM or SIGINT exit once any
+// delivery in progress has finished, leaving messages not yet attempted queued.
+func runDaemon() {
+	dir := path.Dir(viper.ConfigFileUsed())
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Failed to watch queue: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		log.Fatalf("Failed to watch queue: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	// known holds the IDs of queued messages as of the last flush. Changes to
+	// the queue files lead to a check for new messages, rather than a flush,
+	// so that the daemon's own writes do not keep it busy.
+	known := make(map[string]bool)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	check := time.NewTimer(time.Hour)
+	check.Stop()
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("Terminated, exiting")
+			transport.Close()
+			return
+		case <-signals:
+			if err := viper.ReadInConfig(); err != nil {
+				log.Printf("Failed to reload config: %v", err)
+			} else {
+				log.Printf("Reloaded config")
+				configureKeyAgent()
+				flushKeyAgent()
+			}
+			transport.Close()
+			timer.Reset(0)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			switch name := path.Base(ev.Name); {
+			case name == "inflight.json" || name == "queue.db":
+				check.Reset(settleDelay)
+			case strings.HasSuffix(name, ".eml") && ev.Has(fsnotify.Create):
+				check.Reset(settleDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Queue watch error: %v", err)
+		case <-check.C:
+			if ids, err := queuedIDs(); err == nil {
+				for id := range ids {
+					if !known[id] {
+						timer.Reset(0)
+						break
+					}
+				}
+			}
+		case <-timer.C:
+			next, err := flushQueue(ctx)
+			if err != nil {
+				log.Printf("Failed to flush queue: %v", err)
+			}
+			if ids, err := queuedIDs(); err == nil {
+				known = ids
+			}
+			wait := pollInterval
+			if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			timer.Reset(wait)
+		}
+	}
+}
+
+// queuedIDs returns the set of IDs of queued messages.
+func queuedIDs() (map[string]bool, error) {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return nil, err
+	}
+	mc, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(mc))
+	for _, entry := range mc {
+		ids[entry.Message.ID] = true
+	}
+	return ids, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/cache"
+	"github.com/willscott/gosendmail/lib"
+)
+
+// sendDSN delivers a delivery status notification to the sender of a message.
+// It is placed in the configured DSNMaildir or passed to DSNCommand, and
+// otherwise mailed back through the send command of the sender's domain, with
+// a null reverse-path so that it is never answered itself.
+func sendDSN(dsn *lib.DSN) {
+	if dsn.Message.Sender == "" {
+		// There is no one to notify.
+		return
+	}
+	notice, err := dsn.Bytes(time.Now())
+	if err == nil {
+		err = lib.DeliverNotice(notice)
+	}
+	if errors.Is(err, lib.ErrNoNoticeTarget) {
+		parsed := lib.ParseMessage(&notice)
+		parsed.SetSender(lib.NullSender)
+		if err = prepareMessage(parsed, false); err == nil {
+			_, err = trySend(&parsed)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to deliver status notification to %s: %v", dsn.Message.Sender, err)
+	}
+}
+
+// reportRejected notifies the sender of recipients which were permanently
+// rejected in the last delivery attempt of a message.
+func reportRejected(parsed *lib.ParsedMessage, arrival time.Time) {
+	if len(parsed.Rejected) == 0 {
+		return
+	}
+	sendDSN(&lib.DSN{
+		Message:    parsed,
+		Arrival:    arrival,
+		Recipients: lib.NewDSNRecipients(parsed.Rejected, lib.ActionFailed, "5.0.0"),
+	})
+}
+
+// pendingReplies returns the last reply for each remaining recipient of a
+// queued message, or the error of its last attempt where there was none.
+func pendingReplies(entry *cache.Entry) map[string]string {
+	replies := make(map[string]string)
+	for rcpt := range entry.Message.RecipientMap() {
+		if reply, ok := entry.Message.Deferred[rcpt]; ok {
+			replies[rcpt] = reply
+		} else {
+			replies[rcpt] = entry.LastError
+		}
+	}
+	return replies
+}
+
+// reportExpired notifies the sender that a queued message has been given up on.
+func reportExpired(entry *cache.Entry) {
+	sendDSN(&lib.DSN{
+		Message:    &entry.Message,
+		Arrival:    entry.Queued,
+		Recipients: lib.NewDSNRecipients(pendingReplies(entry), lib.ActionFailed, lib.StatusExpired),
+	})
+}
+
+// warnDelayed notifies the sender once that a queued message has been waiting
+// for longer than the `DSNDelayWarning` configuration option, if set.
+func warnDelayed(entry *cache.Entry, now time.Time, policy cache.RetryPolicy) {
+	after := viper.GetDuration("DSNDelayWarning")
+	if after <= 0 || entry.Warned || entry.Dead || now.Sub(entry.Queued) < after {
+		return
+	}
+	sendDSN(&lib.DSN{
+		Message:    &entry.Message,
+		Arrival:    entry.Queued,
+		Recipients: lib.NewDSNRecipients(pendingReplies(entry), lib.ActionDelayed, "4.0.0"),
+		RetryUntil: entry.Queued.Add(policy.Lifetime),
+	})
+	entry.Warned = true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"time"
+
+	"github.com/willscott/gosendmail/cache"
+)
+
+// listQueue prints a summary of each queued message, in the manner of mailq.
+func listQueue() error {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return err
+	}
+	mc, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(mc) == 0 {
+		fmt.Println("Mail queue is empty")
+		return nil
+	}
+	for _, entry := range mc {
+		printEntry(&entry)
+		fmt.Println()
+	}
+	fmt.Printf("%d message(s) queued\n", len(mc))
+	return nil
+}
+
+// printEntry describes a queued message and the state of its delivery.
+func printEntry(entry *cache.Entry) {
+	subject, err := new(mime.WordDecoder).DecodeHeader(entry.Message.Header.Get("Subject"))
+	if err != nil {
+		subject = entry.Message.Header.Get("Subject")
+	}
+	status := "next attempt " + entry.NextAttempt.Local().Format(time.DateTime)
+	if entry.Dead {
+		status = "expired"
+	} else if entry.Leased(time.Now()) {
+		status = "sending"
+	}
+	fmt.Printf("%s  %s  %s\n", entry.Message.ID, entry.Queued.Local().Format(time.DateTime), entry.Message.Sender)
+	fmt.Printf("  Subject:    %s\n", subject)
+	fmt.Printf("  Recipients: %s\n", entry.Message.Recipients())
+	fmt.Printf("  Attempts:   %d, %s\n", entry.Attempts, status)
+	if entry.LastError != "" {
+		fmt.Printf("  Last error: %s\n", entry.LastError)
+	}
+}
+
+// showEntry prints the state of a single queued message followed by its
+// contents.
+func showEntry(id string) error {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return err
+	}
+	entry, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	printEntry(entry)
+	fmt.Println()
+	_, err = os.Stdout.Write(*entry.Message.Bytes)
+	return err
+}
+
+// flushEntry attempts delivery of a single queued message immediately,
+// regardless of its retry schedule, returning the error if it fails.
+func flushEntry(id string) error {
+	_, err := flush(context.Background(), id)
+	return err
+}
+
+// deleteEntry removes a message from the queue along with its payload.
+func deleteEntry(id string) error {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return err
+	}
+	return store.Delete(id)
+}
+
+// dropRecipient removes a recipient from a queued message. The message is
+// deleted if no recipients remain.
+func dropRecipient(id, rcpt string) error {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return err
+	}
+	entry, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	msg := &entry.Message
+	before := len(msg.RecipientMap())
+	if err := msg.RemoveRecipients(rcpt); err != nil {
+		return err
+	}
+	if len(msg.RecipientMap()) == before {
+		return fmt.Errorf("%s is not a recipient of message %s", rcpt, msg.ID)
+	}
+	if len(msg.DestDomain) == 0 {
+		return store.Delete(msg.ID)
+	}
+	return store.UpdateRecipients(msg.ID, msg.Recipients())
+}
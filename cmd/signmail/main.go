@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -15,9 +16,22 @@ import (
 	"github.com/willscott/gosendmail/lib"
 )
 
+// transport holds ssh connections for ssh:// send commands, so that they are
+// reused across messages.
+var transport = &lib.SSHTransport{}
+
 func init() {
 	flag.CommandLine.BoolP("queue", "s", false, "Store message to queue if not sent successfully")
 	flag.CommandLine.BoolP("resume", "r", false, "Attempt delivery of queued messages")
+	flag.CommandLine.Bool("daemon", false, "Run continuously, delivering queued messages as they become due")
+	flag.CommandLine.Bool("list", false, "List queued messages")
+	flag.CommandLine.String("id", "", "Select a queued message by ID (or a unique prefix) for --show, --flush, --delete or --drop-rcpt")
+	flag.CommandLine.Bool("show", false, "Print the queued message selected by --id")
+	flag.CommandLine.Bool("flush", false, "Attempt delivery of the queued message selected by --id now")
+	flag.CommandLine.Bool("delete", false, "Remove the queued message selected by --id")
+	flag.CommandLine.String("drop-rcpt", "", "Remove a recipient from the queued message selected by --id")
+	flag.CommandLine.Bool("dry-run", false, "Prepare and sign the message, then print it and how it would be sent instead of sending it")
+	flag.CommandLine.Bool("dkim-agent", false, "Run the DKIM key agent, holding signing keys until idle for DkimAgentTimeout")
 	flag.CommandLine.StringP("from", "f", "", "Use explicit sender separate from the address parsed in the msg")
 	flag.CommandLine.BoolP("replace-recipients", "o", false, "Overwrite to header recipients / 'forward mode'")
 	flag.CommandLine.BoolP("replace-from", "w", false, "Overwrite to source from address")
@@ -40,30 +54,28 @@ func main() {
 	if err := viper.BindPFlags(flag.CommandLine); err != nil {
 		log.Fatal(err)
 	}
+	configureKeyAgent()
 	explicitFrom := viper.GetString("from")
 	explicitTo := viper.GetString("recipients")
 
-	if viper.GetBool("resume") {
-		mc, err := cache.LoadMessageCache()
-		if err != nil {
+	if viper.GetBool("dkim-agent") {
+		runKeyAgent()
+	} else if viper.GetBool("list") {
+		if err := listQueue(); err != nil {
 			log.Fatalf("Failed to load queue: %v", err)
 		}
-		newMC := new(cache.MessageCache)
-		for _, parsed := range mc {
-			err = trySend(parsed)
-			if err != nil {
-				*newMC = append(*newMC, parsed)
-				log.Printf("Delivery failure: %v", err)
-			} else {
-				if err = parsed.Unlink(); err != nil {
-					log.Printf("Failed to remove cached message: %v", err)
-				}
-			}
+	} else if id := viper.GetString("id"); id != "" {
+		if err := manageQueue(id); err != nil {
+			log.Fatal(err)
 		}
-		err = newMC.Save()
-		if err != nil {
-			log.Fatalf("Failed to save queue: %v", err)
+		transport.Close()
+	} else if viper.GetBool("daemon") {
+		runDaemon()
+	} else if viper.GetBool("resume") {
+		if _, err := flushQueue(context.Background()); err != nil {
+			log.Fatal(err)
 		}
+		transport.Close()
 	} else {
 		// get mail as input
 		msg := lib.ReadMessage(os.Stdin)
@@ -91,17 +103,34 @@ func main() {
 		if err = prepareMessage(parsed, forward); err != nil {
 			log.Fatalf("Failed to prepare message: %v", err)
 		}
+		if viper.GetBool("dry-run") {
+			if err := preview(&parsed); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 
-		err := trySend(parsed)
-		if err != nil {
+		delivered := false
+		err := checkPublished(&parsed)
+		if err == nil {
+			delivered, err = trySend(&parsed)
+		}
+		if delivered {
+			saveSent(&parsed)
+		}
+		reportRejected(&parsed, time.Now())
+		if err != nil && len(parsed.DestDomain) == 0 {
+			log.Fatalf("Failed to send message: %v", err)
+		} else if err != nil {
 			if viper.GetBool("queue") {
 				log.Printf("Failed to send message: %v", err)
-				mc, err := cache.LoadMessageCache()
+				entry := cache.NewEntry(parsed, err, time.Now(), cache.GetRetryPolicy())
+				entry.Sent = delivered
+				store, err := cache.OpenStore()
 				if err != nil {
-					log.Fatalf("Failed to load cache: %v", err)
+					log.Fatalf("Failed to open cache: %v", err)
 				}
-				mc = append(mc, parsed)
-				if err = mc.Save(); err != nil {
+				if err = store.Put(entry); err != nil {
 					log.Fatalf("Failed to save cache: %v", err)
 				}
 			} else {
@@ -111,49 +140,103 @@ func main() {
 	}
 }
 
+// manageQueue performs the queue operation requested by flags on the message
+// with the given ID.
+func manageQueue(id string) error {
+	switch {
+	case viper.GetBool("show"):
+		return showEntry(id)
+	case viper.GetBool("flush"):
+		return flushEntry(id)
+	case viper.GetBool("delete"):
+		return deleteEntry(id)
+	case viper.GetString("drop-rcpt") != "":
+		return dropRecipient(id, viper.GetString("drop-rcpt"))
+	}
+	return fmt.Errorf("--id requires one of --show, --flush, --delete or --drop-rcpt")
+}
+
 func prepareMessage(parsed lib.ParsedMessage, forward bool) error {
 	cfg := lib.GetConfig(parsed.SourceDomain)
 	if cfg == nil {
 		return fmt.Errorf("no configuration for sender %s", parsed.SourceDomain)
 	}
 
-	if err := lib.SanitizeMessage(parsed, cfg, forward); err != nil {
-		return err
-	}
+	// Forwarding breaks the signatures of the original sender, so forwarded
+	// messages are also sealed to vouch for how they arrived.
+	return lib.PrepareMessage(parsed, cfg, forward)
+}
 
-	if cfg.DkimKeyCmd != "" {
-		if err := lib.SignMessage(parsed, cfg); err != nil {
-			return err
-		}
+// checkPublished verifies the DKIM signatures of a prepared message against
+// the keys published in DNS, if `DkimVerifyDNS` is set for its sender, so that
+// a key, selector or record which has drifted apart stops delivery rather
+// than producing mail which fails DKIM everywhere.
+func checkPublished(parsed *lib.ParsedMessage) error {
+	cfg := lib.GetConfig(parsed.SourceDomain)
+	if cfg == nil || !cfg.DkimVerifyDNS {
+		return nil
+	}
+	if err := lib.VerifyDKIM(*parsed.Bytes, parsed.SourceDomain); err != nil {
+		return fmt.Errorf("not sending message failing DKIM against published keys: %w", err)
 	}
 	return nil
 }
 
-func trySend(parsed lib.ParsedMessage) error {
+// trySend passes a message to the configured send command. Recipients which
+// were delivered to or permanently rejected are removed from `parsed`, and
+// whether any were delivered to is returned.
+func trySend(parsed *lib.ParsedMessage) (bool, error) {
 	cfg := lib.GetConfig(parsed.SourceDomain)
 	if cfg == nil {
-		return fmt.Errorf("no configuration for sender %s", parsed.SourceDomain)
+		return false, fmt.Errorf("no configuration for sender %s", parsed.SourceDomain)
 	}
+	pending := len(parsed.RecipientMap())
+	rejected := len(parsed.Rejected)
 
 	// send to remote server.
-	keycmd := strings.Split(cfg.SendCommand, " ")
-	cmd := exec.Command(keycmd[0], keycmd[1:]...)
-	cmd.Env = append(os.Environ(),
-		"GOSENDMAIL_RECIPIENTS="+parsed.Recipients(), "GOSENDMAIL_SENDER="+parsed.Sender)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
+	sender := parsed.Sender
+	if sender == "" {
+		sender = lib.NullSender
+	}
+	env := []string{"GOSENDMAIL_RECIPIENTS=" + parsed.Recipients(), "GOSENDMAIL_SENDER=" + sender,
+		"GOSENDMAIL_FORMAT=json"}
+	var stdout, stderr bytes.Buffer
+	var err error
+	if lib.IsSSHCommand(cfg.SendCommand) {
+		err = transport.Run(cfg, env, bytes.NewReader(*parsed.Bytes), &stdout, &stderr)
+	} else {
+		keycmd := strings.Split(cfg.SendCommand, " ")
+		cmd := exec.Command(keycmd[0], keycmd[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdin = bytes.NewReader(*parsed.Bytes)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
 	}
 
-	go func() {
-		defer stdin.Close()
-		io.Copy(stdin, bytes.NewReader(*parsed.Bytes))
-	}()
-
-	l, err := cmd.CombinedOutput()
-	lib.InterpretLog(string(l), &parsed)
+	// Older sendmail binaries ignore the requested format and only log text.
+	if !lib.InterpretEvents(stdout.String(), parsed) {
+		lib.InterpretLog(stdout.String()+stderr.String(), parsed)
+	}
+	for rcpt, reply := range parsed.Rejected {
+		log.Printf("Recipient %s rejected: %s", rcpt, reply)
+	}
+	delivered := len(parsed.RecipientMap())+len(parsed.Rejected)-rejected < pending
 	if err != nil {
-		return fmt.Errorf("%s: %v", l, err)
+		return delivered, fmt.Errorf("%s: %v", stderr.String(), err)
+	}
+	return delivered, nil
+}
+
+// saveSent stores the message exactly as it was transmitted, after
+// sanitization and signing, in the `SentMaildir` configured for its sender,
+// marked as seen.
+func saveSent(parsed *lib.ParsedMessage) {
+	cfg := lib.GetConfig(parsed.SourceDomain)
+	if cfg == nil || cfg.SentMaildir == "" {
+		return
+	}
+	if _, err := lib.DeliverMaildir(cfg.SentMaildir, *parsed.Bytes, "S"); err != nil {
+		log.Printf("Failed to save sent copy of message: %v", err)
 	}
-	return nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/willscott/gosendmail/lib"
+)
+
+// preview describes how a prepared message would be sent, followed by the
+// message itself, for --dry-run.
+func preview(parsed *lib.ParsedMessage) error {
+	cfg := lib.GetConfig(parsed.SourceDomain)
+	if cfg == nil {
+		return fmt.Errorf("no configuration for sender %s", parsed.SourceDomain)
+	}
+	fmt.Printf("Sender:       %s\n", parsed.Sender)
+	domains := make([]string, 0, len(parsed.Rcpt))
+	for domain := range parsed.Rcpt {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Printf("Recipients:   %s: %s\n", domain, strings.Join(parsed.Rcpt[domain], ", "))
+	}
+	fmt.Printf("Send command: %s\n", cfg.SendCommand)
+
+	m, err := mail.ReadMessage(bytes.NewReader(*parsed.Bytes))
+	if err != nil {
+		return err
+	}
+	sigs := m.Header["Dkim-Signature"]
+	if len(sigs) == 0 {
+		fmt.Printf("DKIM:         not signed\n")
+	}
+	for _, sig := range sigs {
+		tags := lib.ParseTags(sig)
+		fmt.Printf("DKIM:         d=%s s=%s a=%s\n", tags["d"], tags["s"], tags["a"])
+	}
+	if cfg.DkimVerifyDNS {
+		status := "ok"
+		if err := checkPublished(parsed); err != nil {
+			status = err.Error()
+		}
+		fmt.Printf("DNS check:    %s\n", status)
+	}
+	fmt.Println()
+	_, err = os.Stdout.Write(*parsed.Bytes)
+	return err
+}
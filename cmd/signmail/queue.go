@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/willscott/gosendmail/cache"
+)
+
+// leaseDuration bounds how long a flush may spend delivering the messages it
+// has claimed before other processes may retry them.
+const leaseDuration = time.Hour
+
+// flushQueue attempts delivery of each queued message which is due, and
+// returns the time at which the next remaining message becomes due. The
+// returned time is zero if nothing remains to be retried.
+func flushQueue(ctx context.Context) (time.Time, error) {
+	return flush(ctx)
+}
+
+// flush attempts delivery of the queued messages with the given IDs, whether
+// or not they are due, or of every due message if none are given. It returns
+// the time at which the next remaining message becomes due. Failures to
+// deliver the messages named by `ids` are returned, while those of due
+// messages are only logged.
+//
+// Messages are leased from the queue while they are sent, so that new
+// messages can be queued meanwhile and concurrent flushes do not send the
+// same message twice. Once `ctx` is done no further messages are attempted, and
+// those remaining are released back to the queue.
+func flush(ctx context.Context, ids ...string) (time.Time, error) {
+	store, err := cache.OpenStore()
+	if err != nil {
+		return time.Time{}, err
+	}
+	entries, err := store.Lease(time.Now(), leaseDuration, ids...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	policy := cache.GetRetryPolicy()
+	failures := make([]error, 0)
+	for i := range entries {
+		if ctx.Err() != nil {
+			release(store, entries[i:])
+			break
+		}
+		entry := entries[i]
+		now := time.Now()
+		wasDead := entry.Dead
+		delivered := false
+		err := checkPublished(&entry.Message)
+		if err == nil {
+			delivered, err = trySend(&entry.Message)
+		}
+		if delivered && !entry.Sent {
+			saveSent(&entry.Message)
+			entry.Sent = true
+		}
+		reportRejected(&entry.Message, entry.Queued)
+		if err == nil || len(entry.Message.DestDomain) == 0 {
+			if err = store.Delete(entry.Message.ID); err != nil && !errors.Is(err, cache.ErrNotQueued) {
+				log.Printf("Failed to remove cached message: %v", err)
+			}
+			continue
+		}
+		log.Printf("Delivery failure: %v", err)
+		failures = append(failures, fmt.Errorf("message %s: %w", entry.Message.ID, err))
+		entry.Fail(err, now, policy)
+		if entry.Dead && !wasDead {
+			log.Printf("Giving up on message from %s after %d attempts", entry.Message.Sender, entry.Attempts)
+			reportExpired(&entry)
+		}
+		warnDelayed(&entry, now, policy)
+		if err = store.Put(entry); err != nil {
+			log.Printf("Failed to update queue: %v", err)
+		}
+	}
+	next, err := nextDue(store)
+	if err == nil && len(ids) > 0 {
+		err = errors.Join(failures...)
+	}
+	return next, err
+}
+
+// release returns leased entries to the queue without attempting them, so that
+// they may be sent by the next flush.
+func release(store cache.QueueStore, entries []cache.Entry) {
+	for _, entry := range entries {
+		if err := store.Put(entry); err != nil {
+			log.Printf("Failed to release queued message %s: %v", entry.Message.ID, err)
+		}
+	}
+}
+
+// nextDue returns the time at which the next queued message becomes due, or
+// zero if none are waiting to be retried.
+func nextDue(store cache.QueueStore) (time.Time, error) {
+	mc, err := store.List()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	for _, entry := range mc {
+		if !entry.Dead && (next.IsZero() || entry.NextAttempt.Before(next)) {
+			next = entry.NextAttempt
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/willscott/gosendmail/lib"
+)
+
+func init() {
+	flag.CommandLine.StringP("date", "d", "", "Day (YYYY-MM-DD, UTC) to report on. Defaults to yesterday")
+	flag.CommandLine.StringP("out", "o", ".", "Directory to write report messages to")
+	flag.CommandLine.String("from", "", "Address reports are sent from")
+	flag.CommandLine.String("org", "", "Organization name identifying the report submitter")
+	flag.CommandLine.String("contact", "", "Contact information included in reports")
+	flag.CommandLine.Bool("prune", false, "Remove recorded sessions up to the end of the reported day")
+}
+
+// Tlsrpt generates SMTP TLS Reporting (RFC 8460) aggregate reports from the
+// TLS sessions recorded by `sendmail`, for each destination domain publishing
+// a _smtp._tls TXT record. Each report is written as an email message, which
+// can then be signed and sent with `signmail`.
+func main() {
+	// get config
+	viper.AddConfigPath("$HOME/.gosendmail")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flag.CommandLine.Parse(os.Args[1:]) != nil {
+		flag.CommandLine.Usage()
+		return
+	}
+	viper.RegisterAlias("org", "TLSRPTOrganization")
+	viper.RegisterAlias("contact", "TLSRPTContact")
+	viper.RegisterAlias("from", "TLSRPTFrom")
+	if err := viper.BindPFlags(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	if day := viper.GetString("date"); day != "" {
+		if start, err = time.Parse("2006-01-02", day); err != nil {
+			log.Fatalf("Invalid date: %v", err)
+		}
+	}
+	end := start.Add(24 * time.Hour)
+
+	from := viper.GetString("from")
+	if from == "" {
+		log.Fatal("A sending address is required (--from or TLSRPTFrom)")
+	}
+	org := viper.GetString("org")
+	if org == "" {
+		if org, err = os.Hostname(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	contact := viper.GetString("contact")
+	if contact == "" {
+		contact = from
+	}
+
+	store := &lib.TLSSessionStore{Path: path.Join(path.Dir(viper.ConfigFileUsed()), "tlsrpt.jsonl")}
+	sessions, err := store.Load(start, end)
+	if err != nil {
+		log.Fatalf("Failed to load sessions: %v", err)
+	}
+
+	reports := lib.BuildTLSReports(org, contact, start, end, sessions)
+	domains := make([]string, 0, len(reports))
+	for domain := range reports {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rua, err := lib.LookupTLSRPT(ctx, domain)
+		cancel()
+		if err != nil || len(rua) == 0 {
+			continue
+		}
+
+		msg, err := lib.TLSReportMessage(reports[domain], domain, from, rua)
+		if err != nil {
+			log.Fatalf("Failed to generate report for %s: %v", domain, err)
+		}
+		out := path.Join(viper.GetString("out"), fmt.Sprintf("tlsrpt-%s-%s.eml", domain, start.Format("2006-01-02")))
+		if err := os.WriteFile(out, msg, 0600); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+		fmt.Println(out)
+	}
+
+	if viper.GetBool("prune") {
+		if err := store.Prune(end); err != nil {
+			log.Fatalf("Failed to prune sessions: %v", err)
+		}
+	}
+}
@@ -3,14 +3,16 @@ module github.com/willscott/gosendmail
 go 1.21.0
 
 require (
+	filippo.io/age v1.0.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.18.2
-	github.com/willscott/go-dkim v0.0.0-20240117163537-77cb5174ba32
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/crypto v0.18.0
 	golang.org/x/net v0.20.0
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
@@ -0,0 +1,324 @@
+package lib
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC chain validation states, as described in RFC 8617 section 4.4.
+// ChainTempError is only recorded in authentication results, for chains whose
+// keys could not be looked up at the time, and is sealed as ChainFail.
+const (
+	ChainNone      = "none"
+	ChainPass      = "pass"
+	ChainFail      = "fail"
+	ChainTempError = "temperror"
+)
+
+// arcMaxInstance is the greatest instance number an ARC set may have.
+const arcMaxInstance = 50
+
+// ErrARCChainFailed is returned when the newest ARC set of a message already
+// records a failed chain, in which case no further sets may be added.
+var ErrARCChainFailed = errors.New("arc chain has already failed")
+
+// arcSet holds the header fields of one ARC instance. Each should hold
+// exactly one field in a valid chain.
+type arcSet struct {
+	AAR, AMS, AS []headerField
+}
+
+// ARCSealer adds ARC sets to forwarded messages, as described in RFC 8617, so
+// that receivers can trust the authentication results of the original message
+// even though forwarding breaks its DKIM signatures.
+type ARCSealer struct {
+	// LookupTXT overrides the resolution of the TXT records holding the keys
+	// of earlier sealers.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// ARCResult is the authentication status of a message as it was received,
+// which is recorded in the ARC set added when it is forwarded.
+type ARCResult struct {
+	// Chain is the validation status of the ARC chain the message arrived
+	// with, and Instance the highest instance of that chain.
+	Chain    string
+	Instance int
+	// Reason is why the chain failed validation, if it did.
+	Reason error
+	// DKIM holds a result for each DKIM signature of the message, in the form
+	// of RFC 8601, e.g. "dkim=pass header.d=example.com header.s=sel".
+	DKIM []string
+}
+
+// isTemporary indicates if an error is a transient failure to resolve a key,
+// such as a DNS timeout, rather than a failed signature.
+func isTemporary(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Evaluate validates the ARC chain and DKIM signatures of a message as
+// received, before it is modified for forwarding. Temporary failures to look
+// up keys are recorded as "temperror" results.
+func (s *ARCSealer) Evaluate(ctx context.Context, msg []byte) *ARCResult {
+	cv, n, err := s.ValidateChain(ctx, msg)
+	if isTemporary(err) {
+		cv = ChainTempError
+	}
+	result := &ARCResult{Chain: cv, Instance: n, Reason: err}
+
+	fields, body, err := splitMessage(msg)
+	if err != nil {
+		return result
+	}
+	for _, f := range fields {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		tags := ParseTags(f.Value())
+		res := "pass"
+		if err := verifyMessageSignature(ctx, fields, body, f, nil, s.LookupTXT); isTemporary(err) {
+			res = "temperror"
+		} else if err != nil {
+			res = "fail"
+		}
+		result.DKIM = append(result.DKIM, fmt.Sprintf("dkim=%s header.d=%s header.s=%s",
+			res, strings.Join(strings.Fields(tags["d"]), ""), strings.Join(strings.Fields(tags["s"]), "")))
+	}
+	if len(result.DKIM) == 0 {
+		result.DKIM = []string{"dkim=none"}
+	}
+	return result
+}
+
+// Prepare sanitizes and signs a message as PrepareMessage does, sealing
+// forwarded messages with the status they were received with.
+func (s *ARCSealer) Prepare(parsed ParsedMessage, cfg *Config, forward bool) error {
+	keys := cfg.SigningKeys()
+	var received *ARCResult
+	if forward && len(keys) > 0 {
+		// Sanitizing and signing change the fields covered by existing
+		// signatures, so they are evaluated on the message as received.
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		received = s.Evaluate(ctx, crlf(*parsed.Bytes))
+	}
+
+	if err := SanitizeMessage(parsed, cfg, forward); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := SignMessage(parsed, cfg); err != nil {
+		return err
+	}
+	if received != nil {
+		return s.Seal(parsed, cfg, received)
+	}
+	return nil
+}
+
+// arcSets collects the ARC header fields of a message by instance, returning
+// them along with the highest instance found.
+func arcSets(fields []headerField) (map[int]*arcSet, int, error) {
+	sets := make(map[int]*arcSet)
+	highest := 0
+	for _, f := range fields {
+		name := strings.ToLower(f.Name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		var inst string
+		if name == "arc-authentication-results" {
+			// the instance tag precedes the free form results.
+			inst, _, _ = strings.Cut(f.Value(), ";")
+			_, inst, _ = strings.Cut(inst, "=")
+		} else {
+			inst = ParseTags(f.Value())["i"]
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(inst))
+		if err != nil || i < 1 || i > arcMaxInstance {
+			return nil, 0, fmt.Errorf("invalid arc instance in %s", f.Name)
+		}
+		if sets[i] == nil {
+			sets[i] = &arcSet{}
+		}
+		switch name {
+		case "arc-authentication-results":
+			sets[i].AAR = append(sets[i].AAR, f)
+		case "arc-message-signature":
+			sets[i].AMS = append(sets[i].AMS, f)
+		case "arc-seal":
+			sets[i].AS = append(sets[i].AS, f)
+		}
+		if i > highest {
+			highest = i
+		}
+	}
+	return sets, highest, nil
+}
+
+// sealedFields lists the fields covered by the ARC-Seal of instance `i`, in
+// order, excluding that seal itself.
+func sealedFields(sets map[int]*arcSet, i int) []headerField {
+	out := make([]headerField, 0, 3*i)
+	for j := 1; j <= i; j++ {
+		out = append(out, sets[j].AAR[0], sets[j].AMS[0])
+		if j < i {
+			out = append(out, sets[j].AS[0])
+		}
+	}
+	return out
+}
+
+// ValidateChain determines the chain validation status of the ARC sets of a
+// message, per RFC 8617 section 5.2, along with the highest instance present.
+// The reason for a failure is returned as an error.
+func (s *ARCSealer) ValidateChain(ctx context.Context, msg []byte) (string, int, error) {
+	fields, body, err := splitMessage(msg)
+	if err != nil {
+		return ChainFail, 0, err
+	}
+	sets, n, err := arcSets(fields)
+	if err != nil {
+		return ChainFail, 0, err
+	}
+	if n == 0 {
+		return ChainNone, 0, nil
+	}
+	for i := 1; i <= n; i++ {
+		set := sets[i]
+		if set == nil || len(set.AAR) != 1 || len(set.AMS) != 1 || len(set.AS) != 1 {
+			return ChainFail, n, fmt.Errorf("arc set %d is incomplete or duplicated", i)
+		}
+	}
+	if ParseTags(sets[n].AS[0].Value())["cv"] == ChainFail {
+		return ChainFail, n, ErrARCChainFailed
+	}
+	for i := 1; i <= n; i++ {
+		want := ChainPass
+		if i == 1 {
+			want = ChainNone
+		}
+		if cv := ParseTags(sets[i].AS[0].Value())["cv"]; cv != want {
+			return ChainFail, n, fmt.Errorf("arc seal %d has cv=%s", i, cv)
+		}
+	}
+
+	if err := verifyMessageSignature(ctx, fields, body, sets[n].AMS[0], nil, s.LookupTXT); err != nil {
+		return ChainFail, n, fmt.Errorf("arc message signature %d: %w", n, err)
+	}
+	for i := n; i >= 1; i-- {
+		seal := sets[i].AS[0]
+		tags := ParseTags(seal.Value())
+		sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["b"]), ""))
+		if err != nil {
+			return ChainFail, n, fmt.Errorf("arc seal %d: invalid b= tag: %w", i, err)
+		}
+		pub, err := lookupDkimKey(ctx, s.LookupTXT, tags["s"], tags["d"])
+		if err != nil {
+			return ChainFail, n, fmt.Errorf("arc seal %d: %w", i, err)
+		}
+		if err := verifyDigest(pub, tags["a"], headerHash(sealedFields(sets, i), seal, true), sig); err != nil {
+			return ChainFail, n, fmt.Errorf("arc seal %d: %w", i, err)
+		}
+	}
+	return ChainPass, n, nil
+}
+
+// Seal adds an ARC set to a message, recording the authentication status
+// `received` it arrived with, and signed with the first DKIM key configured
+// for the sending domain. The buffer is modified in place. Messages whose
+// chain has already failed, or which have reached the maximum number of sets,
+// are left unchanged. A chain which could not be validated is sealed as failed.
+func (s *ARCSealer) Seal(parsed ParsedMessage, cfg *Config, received *ARCResult) error {
+	keys := cfg.SigningKeys()
+	if len(keys) == 0 {
+		return fmt.Errorf("no DKIM key configured for %s", parsed.SourceDomain)
+	}
+
+	cv, n := received.Chain, received.Instance
+	if cv == ChainTempError {
+		cv = ChainFail
+	}
+	if errors.Is(received.Reason, ErrARCChainFailed) || n >= arcMaxInstance {
+		return nil
+	}
+	fields, body, err := splitMessage(*parsed.Bytes)
+	if err != nil {
+		return err
+	}
+
+	signer, algo, err := dkimSigner(keys[0].KeyCmd)
+	if err != nil {
+		return err
+	}
+	selector := "default"
+	if keys[0].Selector != "" {
+		selector = keys[0].Selector
+	}
+	authserv := parsed.SourceDomain
+	if cfg.SourceHost != "" {
+		authserv = cfg.SourceHost
+	}
+	i := strconv.Itoa(n + 1)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	results := "i=" + i + "; " + authserv + "; arc=" + received.Chain
+	for _, r := range received.DKIM {
+		results += ";\r\n\t" + r
+	}
+	aar := headerField{
+		Name: "ARC-Authentication-Results",
+		Raw:  "ARC-Authentication-Results: " + results + "\r\n",
+	}
+
+	names := signedHeaders(fields, cfg)
+	amsTags := []string{"i=" + i, "a=" + algo, "c=relaxed/relaxed", "d=" + parsed.SourceDomain,
+		"s=" + selector, "t=" + now, "h=" + strings.Join(names, ":"), "bh=" + bodyHash(body, true, -1)}
+	ams, err := signField("ARC-Message-Signature", amsTags, selectHeaders(fields, names), signer)
+	if err != nil {
+		return err
+	}
+
+	// The seal covers every set of a valid chain, but only its own set when
+	// the chain has failed.
+	covered := []headerField{aar, ams}
+	if cv != ChainFail {
+		sets, _, _ := arcSets(fields)
+		sets[n+1] = &arcSet{AAR: []headerField{aar}, AMS: []headerField{ams}}
+		covered = sealedFields(sets, n+1)
+	}
+	sealTags := []string{"i=" + i, "a=" + algo, "cv=" + cv, "d=" + parsed.SourceDomain, "s=" + selector, "t=" + now}
+	seal, err := signField("ARC-Seal", sealTags, covered, signer)
+	if err != nil {
+		return err
+	}
+
+	*parsed.Bytes = append([]byte(seal.Raw+ams.Raw+aar.Raw), *parsed.Bytes...)
+	return nil
+}
+
+// signField creates a signature header field with the given tags, signing
+// the relaxed canonicalization of `covered` followed by the field itself.
+func signField(name string, tags []string, covered []headerField, signer crypto.Signer) (headerField, error) {
+	unsigned := headerField{Name: name, Raw: name + ":" + foldTags(append(tags, "b=")...) + "\r\n"}
+	sig, err := signDigest(signer, headerHash(covered, unsigned, true))
+	if err != nil {
+		return headerField{}, err
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	return headerField{Name: name, Raw: name + ":" + foldTags(append(tags, "b="+b)...) + "\r\n"}, nil
+}
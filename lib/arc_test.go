@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// dkimRecord formats the DKIM key record publishing a public key.
+func dkimRecord(t *testing.T, pub crypto.PublicKey) string {
+	if ed, ok := pub.(ed25519.PublicKey); ok {
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(ed)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+// staticTXT resolves TXT records from a fixed table.
+func staticTXT(records map[string]string) func(context.Context, string) ([]string, error) {
+	return func(_ context.Context, name string) ([]string, error) {
+		if r, ok := records[name]; ok {
+			return []string{r}, nil
+		}
+		return nil, fmt.Errorf("no such record %s", name)
+	}
+}
+
+func TestARCSeal(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := &ARCSealer{LookupTXT: staticTXT(map[string]string{
+		"rsa._domainkey.example.com": dkimRecord(t, rsaKey.Public()),
+		"ed._domainkey.example.org":  dkimRecord(t, edPub),
+	})}
+	first := &Config{DkimKeyCmd: writeKey(t, dir, "rsa.pem", rsaKey), DkimSelector: "rsa"}
+	second := &Config{DkimKeys: []DkimKey{{KeyCmd: writeKey(t, dir, "ed.pem", edKey), Selector: "ed"}}, SourceHost: "mx.example.org"}
+	seal := func(msg ParsedMessage, cfg *Config) error {
+		return sealer.Seal(msg, cfg, sealer.Evaluate(context.Background(), *msg.Bytes))
+	}
+
+	content := []byte("From: alice@example.net\r\nTo: bob@example.com\r\nSubject: hi\r\n\r\nbody  \r\n\r\n")
+	msg := ParseMessage(&content)
+	msg.SourceDomain = "example.com"
+	if err := seal(msg, first); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(*msg.Bytes, []byte("cv=none")) || !bytes.Contains(*msg.Bytes, []byte("i=1; example.com; arc=none;\r\n\tdkim=none")) {
+		t.Fatalf("unexpected first arc set:\n%s", *msg.Bytes)
+	}
+	if cv, n, err := sealer.ValidateChain(context.Background(), *msg.Bytes); cv != ChainPass || n != 1 {
+		t.Fatalf("first seal did not validate: %s %d %v", cv, n, err)
+	}
+
+	// a second hop extends the chain.
+	msg.SourceDomain = "example.org"
+	if err := seal(msg, second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(*msg.Bytes, []byte("i=2; mx.example.org; arc=pass")) || !bytes.Contains(*msg.Bytes, []byte("cv=pass")) {
+		t.Fatalf("unexpected second arc set:\n%s", *msg.Bytes)
+	}
+	if cv, n, err := sealer.ValidateChain(context.Background(), *msg.Bytes); cv != ChainPass || n != 2 {
+		t.Fatalf("second seal did not validate: %s %d %v", cv, n, err)
+	}
+
+	// modification after sealing breaks the chain.
+	tampered := bytes.Replace(*msg.Bytes, []byte("body"), []byte("spam"), 1)
+	if cv, _, err := sealer.ValidateChain(context.Background(), tampered); cv != ChainFail || err == nil {
+		t.Fatalf("tampered message validated: %s", cv)
+	}
+	tampered = bytes.Replace(*msg.Bytes, []byte("arc=none"), []byte("arc=pass"), 1)
+	if cv, _, err := sealer.ValidateChain(context.Background(), tampered); cv != ChainFail || err == nil {
+		t.Fatalf("tampered seal validated: %s", cv)
+	}
+
+	// a broken chain is sealed as failed, after which no more sets are added.
+	msg.Bytes = &tampered
+	if err := seal(msg, first); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(*msg.Bytes), "cv=fail") {
+		t.Fatalf("broken chain not sealed as failed:\n%s", *msg.Bytes)
+	}
+	sealed := len(*msg.Bytes)
+	if err := seal(msg, first); err != nil || len(*msg.Bytes) != sealed {
+		t.Fatalf("failed chain was sealed again: %v", err)
+	}
+}
+
+func TestARCForward(t *testing.T) {
+	dir := t.TempDir()
+	netKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgPub, orgKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := &ARCSealer{LookupTXT: staticTXT(map[string]string{
+		"net._domainkey.example.net": dkimRecord(t, netKey.Public()),
+		"com._domainkey.example.com": dkimRecord(t, comKey.Public()),
+		"org._domainkey.example.org": dkimRecord(t, orgPub),
+	})}
+
+	// the message is signed by its author, then sealed by a first forwarder.
+	content := []byte("Date: Mon, 2 Jan 2006 15:04:05 +0000\r\nDelivered-To: bob@example.com\r\n" +
+		"From: alice@example.net\r\nTo: bob@example.com\r\nSubject: hi\r\n\r\nbody\r\n")
+	msg := ParseMessage(&content)
+	if err := SignMessage(msg, &Config{DkimKeyCmd: writeKey(t, dir, "net.pem", netKey), DkimSelector: "net"}); err != nil {
+		t.Fatal(err)
+	}
+	received := sealer.Evaluate(context.Background(), *msg.Bytes)
+	msg.SourceDomain = "example.com"
+	if err := sealer.Seal(msg, &Config{DkimKeyCmd: writeKey(t, dir, "com.pem", comKey), DkimSelector: "com"}, received); err != nil {
+		t.Fatal(err)
+	}
+
+	// forwarding it again replaces the Date and drops Delivered-To, which
+	// breaks the earlier signatures, but the status as received is recorded.
+	msg.SourceDomain = "example.org"
+	cfg := &Config{DkimKeys: []DkimKey{{KeyCmd: writeKey(t, dir, "org.pem", orgKey), Selector: "org"}}, SourceHost: "mx.example.org"}
+	if err := sealer.Prepare(msg, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := string(*msg.Bytes)
+	if strings.Contains(forwarded, "Delivered-To") {
+		t.Fatalf("forwarded message not sanitized:\n%s", forwarded)
+	}
+	if !strings.Contains(forwarded, "i=2; mx.example.org; arc=pass;\r\n\tdkim=pass header.d=example.net header.s=net") ||
+		!strings.Contains(forwarded, "ARC-Seal: i=2;\r\n\ta=ed25519-sha256;\r\n\tcv=pass;") {
+		t.Fatalf("chain not sealed as received:\n%s", forwarded)
+	}
+	if cv, n, err := sealer.ValidateChain(context.Background(), *msg.Bytes); cv != ChainPass || n != 2 {
+		t.Fatalf("forwarded chain did not validate: %s %d %v", cv, n, err)
+	}
+
+	// keys which cannot be looked up for now are recorded as temporary
+	// errors, and the message is still sent, sealed as failed.
+	timeout := &ARCSealer{LookupTXT: func(_ context.Context, name string) ([]string, error) {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}}
+	if err := timeout.Prepare(msg, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	forwarded = string(*msg.Bytes)
+	if !strings.Contains(forwarded, "i=3; mx.example.org; arc=temperror;\r\n\tdkim=temperror header.d=example.org header.s=org") ||
+		!strings.Contains(forwarded, "ARC-Seal: i=3;\r\n\ta=ed25519-sha256;\r\n\tcv=fail;") {
+		t.Fatalf("temporary failure not recorded:\n%s", forwarded)
+	}
+}
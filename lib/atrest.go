@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+)
+
+// ageHeader begins every age encrypted file.
+var ageHeader = []byte("age-encryption.org/v1\n")
+
+// ErrNoQueueIdentity is returned when encrypted queue data is read without a
+// configured `QueueIdentityCmd`.
+var ErrNoQueueIdentity = errors.New("queue is encrypted but no QueueIdentityCmd is configured")
+
+var (
+	identityMu sync.Mutex
+	identities []age.Identity
+)
+
+// QueueEncryption indicates if queued data is encrypted, which is the case
+// when the `QueueRecipient` configuration option lists one or more age public
+// keys.
+func QueueEncryption() bool {
+	return len(viper.GetStringSlice("QueueRecipient")) > 0
+}
+
+// SealQueueData encrypts data to the recipients configured by `QueueRecipient`.
+// Data is returned unchanged if none are configured.
+func SealQueueData(data []byte) ([]byte, error) {
+	keys := viper.GetStringSlice("QueueRecipient")
+	if len(keys) == 0 {
+		return data, nil
+	}
+	recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(keys, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid QueueRecipient: %w", err)
+	}
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// IsSealed indicates if data was encrypted by SealQueueData.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, ageHeader)
+}
+
+// OpenQueueData decrypts data encrypted by SealQueueData, using the identity
+// output by the `QueueIdentityCmd` configuration option. The command is run
+// once per process. Data which is not encrypted is returned unchanged, so that
+// queues written before encryption was configured remain readable.
+func OpenQueueData(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	ids, err := queueIdentities()
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func queueIdentities() ([]age.Identity, error) {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+	if identities != nil {
+		return identities, nil
+	}
+
+	cmdLine := viper.GetString("QueueIdentityCmd")
+	if cmdLine == "" {
+		return nil, ErrNoQueueIdentity
+	}
+	args := strings.Split(cmdLine, " ")
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve queue identity: %w", err)
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse queue identity: %w", err)
+	}
+	identities = ids
+	return identities, nil
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+)
+
+// useQueueKey configures encryption of queued data to a new key.
+func useQueueKey(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(t.TempDir(), "queue.key")
+	if err := os.WriteFile(keyFile, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("QueueRecipient", id.Recipient().String())
+	viper.Set("QueueIdentityCmd", "cat "+keyFile)
+	identities = nil
+	t.Cleanup(func() {
+		viper.Reset()
+		identities = nil
+	})
+}
+
+func TestQueueEncryption(t *testing.T) {
+	plain := []byte("From: a@example.com\r\n\r\nsecret\r\n")
+
+	// without a key data passes through.
+	if out, err := SealQueueData(plain); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("unexpected transformation without a key: %v", err)
+	}
+
+	useQueueKey(t)
+	sealed, err := SealQueueData(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("data not encrypted")
+	}
+	if out, err := OpenQueueData(sealed); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	// data written before encryption was configured is still readable.
+	if out, err := OpenQueueData(plain); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("failed to read plaintext: %v", err)
+	}
+
+	file := path.Join(t.TempDir(), "msg.eml")
+	if err := WriteDiskOutput(file, plain); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _ := os.ReadFile(file)
+	if !IsSealed(onDisk) {
+		t.Fatal("file not encrypted on disk")
+	}
+	if out, err := ParseDiskInput(file); err != nil || !bytes.Equal(out, plain) {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+
+	viper.Set("QueueIdentityCmd", "")
+	identities = nil
+	if _, err := OpenQueueData(sealed); err != ErrNoQueueIdentity {
+		t.Fatalf("expected missing identity to fail, got %v", err)
+	}
+}
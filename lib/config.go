@@ -3,44 +3,79 @@ package lib
 import (
 	"bytes"
 	"crypto/tls"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/viper"
 )
 
+// DkimKey is a key that messages are signed with, and the selector under
+// which its public key is published.
+type DkimKey struct {
+	KeyCmd   string
+	Selector string
+}
+
 // Config represents the structure of a single domain configuration
 // in config.json
 type Config struct {
 	DkimKeyCmd   string
 	DkimSelector string
+	// DkimKeys are additional keys, each adding its own signature, e.g. so
+	// that messages carry both an RSA and an Ed25519 signature.
+	DkimKeys []DkimKey
+	// DkimVerifyDNS requires signatures to verify against the keys published
+	// in DNS before a message is sent.
+	DkimVerifyDNS bool
+	// DkimHeaders overrides the headers included in signatures.
+	DkimHeaders []string
+	// DkimOversign overrides the headers signed one extra time, guarding
+	// against further instances being added to a signed message.
+	DkimOversign []string
 	DialerProxy  string
 	SourceHost   string
 	TLSCert      string
 	TLSKey       string
 	tlscfg       *tls.Config
 	SendCommand  string
+	// SSHKey and SSHKnownHosts are used when SendCommand is an ssh:// URL.
+	SSHKey        string
+	SSHKnownHosts string
+	// SentMaildir is a Maildir in which to keep a copy of each message as it
+	// was sent.
+	SentMaildir string
+}
+
+// SigningKeys lists every DKIM key messages should be signed with: the one
+// given by `DkimKeyCmd`, if any, followed by `DkimKeys`.
+func (c *Config) SigningKeys() []DkimKey {
+	keys := make([]DkimKey, 0, len(c.DkimKeys)+1)
+	if c.DkimKeyCmd != "" {
+		keys = append(keys, DkimKey{KeyCmd: c.DkimKeyCmd, Selector: c.DkimSelector})
+	}
+	return append(keys, c.DkimKeys...)
 }
 
 // GetTLS returns a TLS configuration (the epxected certificate and server name)
 // for a given configured domain.
-func (c *Config) GetTLS() *tls.Config {
+func (c *Config) GetTLS() (*tls.Config, error) {
 	if c.tlscfg != nil {
-		return c.tlscfg
+		return c.tlscfg, nil
 	}
 	if c.TLSCert != "" {
 		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		c.tlscfg = &tls.Config{Certificates: []tls.Certificate{cert}}
 	} else {
 		c.tlscfg = &tls.Config{}
 	}
 
-	return c.tlscfg
+	return c.tlscfg, nil
 }
 
 // GetConfig looks for a domain in the currently loaded configuration
@@ -68,6 +103,33 @@ func GetConfig(domain string) *Config {
 	if dkimselector, ok := cfgMap["dkimselector"].(string); ok {
 		cfg.DkimSelector = dkimselector
 	}
+	if verify, ok := cfgMap["dkimverifydns"].(bool); ok {
+		cfg.DkimVerifyDNS = verify
+	}
+	if headers, ok := cfgMap["dkimheaders"].([]interface{}); ok {
+		cfg.DkimHeaders = stringList(headers)
+	}
+	if oversign, ok := cfgMap["dkimoversign"].([]interface{}); ok {
+		cfg.DkimOversign = stringList(oversign)
+	}
+	if keys, ok := cfgMap["dkimkeys"].([]interface{}); ok {
+		for _, k := range keys {
+			keyMap, ok := k.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key := DkimKey{}
+			for name, val := range keyMap {
+				s, _ := val.(string)
+				if strings.EqualFold(name, "keycmd") {
+					key.KeyCmd = s
+				} else if strings.EqualFold(name, "selector") {
+					key.Selector = s
+				}
+			}
+			cfg.DkimKeys = append(cfg.DkimKeys, key)
+		}
+	}
 	if proxy, ok := cfgMap["dialerproxy"].(string); ok {
 		cfg.DialerProxy = proxy
 	}
@@ -83,27 +145,66 @@ func GetConfig(domain string) *Config {
 	if sourceHost, ok := cfgMap["sourcehost"].(string); ok {
 		cfg.SourceHost = sourceHost
 	}
+	if sshKey, ok := cfgMap["sshkey"].(string); ok {
+		cfg.SSHKey = sshKey
+	}
+	if knownHosts, ok := cfgMap["sshknownhosts"].(string); ok {
+		cfg.SSHKnownHosts = knownHosts
+	}
+	if sent, ok := cfgMap["sentmaildir"].(string); ok {
+		cfg.SentMaildir = sent
+	}
 
 	return &cfg
 }
 
-// ParseDiskInput reads a filename, transforming the data with a configured
+// stringList converts a configured list to strings, skipping other values.
+func stringList(l []interface{}) []string {
+	out := make([]string, 0, len(l))
+	for _, v := range l {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// ParseDiskInput reads a filename, decrypting data written with
+// `QueueRecipient` set, or else transforming the data with a configured
 // 'ReadFromDisk' command if set. This allows messages to be passed through
 // a gpg encryption process if desired.
 func ParseDiskInput(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// files written with `QueueRecipient` set are decrypted natively.
+	header := make([]byte, len(ageHeader))
+	n, _ := io.ReadFull(file, header)
+	if IsSealed(header[:n]) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return OpenQueueData(data)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
 	cfg := viper.Get("ReadFromDisk")
 	if cfg == nil {
-		return os.ReadFile(filename)
+		return io.ReadAll(file)
 	}
 
 	readCmdLine, ok := cfg.(string)
 	if !ok {
-		return os.ReadFile(filename)
-	}
-
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+		return io.ReadAll(file)
 	}
 
 	readCmdArgs := strings.Split(readCmdLine, " ")
@@ -112,28 +213,70 @@ func ParseDiskInput(filename string) ([]byte, error) {
 	return readCmd.Output()
 }
 
-// WriteDiskOutput writes a bytestring to a desired file on disk, transforming
-// the data through a configured `WriteToDisk` command if set. This allows
-// messages to be passed through a gpg encryption process if desired.
+// WriteDiskOutput writes a bytestring to a desired file on disk, encrypting it
+// to the configured `QueueRecipient` if set, or else transforming the data
+// through a configured `WriteToDisk` command if set. This allows messages to be
+// passed through a gpg encryption process if desired. The file is replaced
+// atomically, so that it is never left partially written.
 func WriteDiskOutput(filename string, data []byte) error {
+	if QueueEncryption() {
+		sealed, err := SealQueueData(data)
+		if err != nil {
+			return err
+		}
+		return WriteFileAtomic(filename, sealed)
+	}
+
 	cfg := viper.Get("WriteToDisk")
 	if cfg == nil {
-		return os.WriteFile(filename, data, 0600)
+		return WriteFileAtomic(filename, data)
 	}
 
 	writeCmdLine, ok := cfg.(string)
 	if !ok {
-		return os.WriteFile(filename, data, 0600)
+		return WriteFileAtomic(filename, data)
 	}
 
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0600)
+	return writeAtomic(filename, func(file *os.File) error {
+		writeCmdArgs := strings.Split(writeCmdLine, " ")
+		writeCmd := exec.Command(writeCmdArgs[0], writeCmdArgs[1:]...)
+		writeCmd.Stdin = bytes.NewReader(data)
+		writeCmd.Stdout = file
+		return writeCmd.Run()
+	})
+}
+
+// WriteFileAtomic writes data to a file by way of a temporary file in the same
+// directory, so that the file is either fully written or left unchanged.
+func WriteFileAtomic(filename string, data []byte) error {
+	return writeAtomic(filename, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// writeAtomic writes a file through a temporary file named
+// ".<name>.tmp<random>", which is left behind only if the process crashes.
+func writeAtomic(filename string, write func(*os.File) error) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+base+".tmp*")
 	if err != nil {
 		return err
 	}
-
-	writeCmdArgs := strings.Split(writeCmdLine, " ")
-	writeCmd := exec.Command(writeCmdArgs[0], writeCmdArgs[1:]...)
-	writeCmd.Stdin = bytes.NewReader(data)
-	writeCmd.Stdout = file
-	return writeCmd.Run()
+	defer os.Remove(file.Name())
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
 }
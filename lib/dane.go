@@ -0,0 +1,298 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TLSA certificate usages relevant to SMTP (RFC 7672 section 3.1).
+const (
+	TLSAUsageDANETA = 2
+	TLSAUsageDANEEE = 3
+)
+
+// typeTLSA is the DNS resource record type of TLSA records.
+const typeTLSA = dnsmessage.Type(52)
+
+// ErrInsecureDNS is returned when a DNS answer was not validated with DNSSEC.
+// Per RFC 7672, such TLSA records must be treated as if they did not exist.
+var ErrInsecureDNS = errors.New("dns answer not dnssec validated")
+
+// TLSA is a TLSA record (RFC 6698) describing the certificate a server presents.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// Usable indicates if the record is one that can authenticate an SMTP server.
+func (t TLSA) Usable() bool {
+	return (t.Usage == TLSAUsageDANETA || t.Usage == TLSAUsageDANEEE) &&
+		t.Selector <= 1 && t.MatchingType <= 2
+}
+
+// Matches checks if the record describes a given certificate.
+func (t TLSA) Matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch t.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch t.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, t.Data)
+}
+
+// TLSAResolver looks up the TLSA records of a service, e.g. _25._tcp.mx.example.com.
+// Implementations return ErrInsecureDNS if the records were not DNSSEC validated.
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) ([]TLSA, error)
+	// SecureMX reports if the MX records of a domain, or their absence, were
+	// DNSSEC validated. Per RFC 7672 section 2.2.1, DANE does not apply to
+	// servers found through an insecure MX lookup.
+	SecureMX(ctx context.Context, domain string) (bool, error)
+}
+
+// DNSSECResolver looks up TLSA and MX records from a DNSSEC-validating recursive
+// resolver, trusting its AD bit. The path to the resolver must be trusted,
+// typically by running it on localhost.
+type DNSSECResolver struct {
+	// Server is the host:port of the resolver. If empty, the first nameserver
+	// in /etc/resolv.conf is used.
+	Server string
+}
+
+func (d *DNSSECResolver) server() (string, error) {
+	if d.Server != "" {
+		return d.Server, nil
+	}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver configured")
+}
+
+// LookupTLSA queries the TLSA records at `name`.
+func (d *DNSSECResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	resp, err := d.query(ctx, name, typeTLSA)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Header.AuthenticData {
+		return nil, ErrInsecureDNS
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("looking up %s: %s", name, resp.Header.RCode)
+	}
+
+	records := make([]TLSA, 0, len(resp.Answers))
+	for _, answer := range resp.Answers {
+		if answer.Header.Type != typeTLSA {
+			continue
+		}
+		raw, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(raw.Data) < 3 {
+			continue
+		}
+		records = append(records, TLSA{
+			Usage:        raw.Data[0],
+			Selector:     raw.Data[1],
+			MatchingType: raw.Data[2],
+			Data:         raw.Data[3:],
+		})
+	}
+	return records, nil
+}
+
+// SecureMX checks if the resolver validated the MX records of `domain`.
+func (d *DNSSECResolver) SecureMX(ctx context.Context, domain string) (bool, error) {
+	resp, err := d.query(ctx, domain, dnsmessage.TypeMX)
+	if err != nil {
+		return false, err
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		return resp.Header.AuthenticData, nil
+	default:
+		return false, fmt.Errorf("looking up mx of %s: %s", domain, resp.Header.RCode)
+	}
+}
+
+// query asks the resolver for the records of a given type at `name`, setting
+// the AD bit so that the response indicates if it was DNSSEC validated.
+func (d *DNSSECResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	server, err := d.server()
+	if err != nil {
+		return nil, err
+	}
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(time.Now().UnixNano())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchange(ctx, "udp", server, query)
+	if err == nil && resp.Header.Truncated {
+		resp, err = exchange(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.ID != id {
+		return nil, errors.New("mismatched dns response")
+	}
+	return resp, nil
+}
+
+// exchange sends a DNS query to a server and parses the response.
+func exchange(ctx context.Context, network, server string, query []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		framed := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+		if _, err = conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		n = int(length[0])<<8 | int(length[1])
+		if _, err = io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := new(dnsmessage.Message)
+	if err := msg.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// VerifyDANE checks the certificates presented by a server against its usable
+// TLSA records as described in RFC 7672. DANE-EE records match the server's
+// certificate directly, without name or expiry checks. DANE-TA records match a
+// certificate in the presented chain, which must then issue the server's
+// certificate for `serverName`.
+func VerifyDANE(cs tls.ConnectionState, serverName string, records []TLSA) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	for _, rec := range records {
+		if !rec.Usable() {
+			continue
+		}
+		if rec.Usage == TLSAUsageDANEEE {
+			if rec.Matches(leaf) {
+				return nil
+			}
+			continue
+		}
+
+		for _, ta := range cs.PeerCertificates {
+			if !rec.Matches(ta) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ta)
+			opts := x509.VerifyOptions{
+				DNSName:       serverName,
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if _, err := leaf.Verify(opts); err == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("no tlsa record matches the server certificate")
+}
@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func makeCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyDANE(t *testing.T) {
+	ca, caKey := makeCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, _ := makeCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	leafSPKI := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	ee := TLSA{Usage: TLSAUsageDANEEE, Selector: 1, MatchingType: 1, Data: leafSPKI[:]}
+	if err := VerifyDANE(cs, "other.example.com", []TLSA{ee}); err != nil {
+		t.Fatalf("DANE-EE should match regardless of name: %v", err)
+	}
+
+	ta := TLSA{Usage: TLSAUsageDANETA, Selector: 0, MatchingType: 0, Data: ca.Raw}
+	if err := VerifyDANE(cs, "mx.example.com", []TLSA{ta}); err != nil {
+		t.Fatalf("DANE-TA should validate chain: %v", err)
+	}
+	if err := VerifyDANE(cs, "other.example.com", []TLSA{ta}); err == nil {
+		t.Fatal("DANE-TA should check the server name")
+	}
+
+	wrong := TLSA{Usage: TLSAUsageDANEEE, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}
+	if err := VerifyDANE(cs, "mx.example.com", []TLSA{wrong}); err == nil {
+		t.Fatal("mismatched record should not verify")
+	}
+	pkixEE := TLSA{Usage: 1, Selector: 1, MatchingType: 1, Data: leafSPKI[:]}
+	if pkixEE.Usable() {
+		t.Fatal("PKIX usages are not usable for SMTP")
+	}
+}
+
+// serveDNS answers queries over udp with empty responses, setting the AD bit
+// only for names in `secure`.
+func serveDNS(t *testing.T, secure map[string]bool) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			resp := dnsmessage.Message{
+				Header: dnsmessage.Header{
+					ID:            query.Header.ID,
+					Response:      true,
+					AuthenticData: secure[query.Questions[0].Name.String()],
+				},
+				Questions: query.Questions,
+			}
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSecureMX(t *testing.T) {
+	d := &DNSSECResolver{Server: serveDNS(t, map[string]bool{"signed.example.com.": true})}
+	ctx := context.Background()
+	if ok, err := d.SecureMX(ctx, "signed.example.com"); err != nil || !ok {
+		t.Fatalf("expected a validated mx lookup: %v %v", ok, err)
+	}
+	if ok, err := d.SecureMX(ctx, "unsigned.example.com"); err != nil || ok {
+		t.Fatalf("expected an insecure mx lookup: %v %v", ok, err)
+	}
+	if _, err := d.LookupTLSA(ctx, "_25._tcp.unsigned.example.com"); !errors.Is(err, ErrInsecureDNS) {
+		t.Fatalf("expected insecure tlsa records to be rejected: %v", err)
+	}
+}
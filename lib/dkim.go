@@ -0,0 +1,382 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature algorithms, as named in DKIM and ARC signatures.
+const (
+	AlgoRSASHA256     = "rsa-sha256"
+	AlgoEd25519SHA256 = "ed25519-sha256"
+)
+
+// ErrBadSignature is returned when a DKIM or ARC signature does not verify.
+var ErrBadSignature = errors.New("signature does not verify")
+
+// headerField is a single header of a message, as it appears in the message.
+type headerField struct {
+	Name string
+	// Raw is the complete field, including any folding and the final CRLF.
+	Raw string
+}
+
+// Value returns the unparsed value of the field.
+func (h headerField) Value() string {
+	_, v, _ := strings.Cut(h.Raw, ":")
+	return v
+}
+
+// splitMessage separates the header fields of a message from its body.
+func splitMessage(msg []byte) ([]headerField, []byte, error) {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end == -1 {
+		return nil, nil, errors.New("couldn't locate end of headers")
+	}
+	fields := make([]headerField, 0)
+	for _, line := range strings.SplitAfter(string(msg[:end+2]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Raw += line
+			continue
+		}
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed header line %q", strings.TrimSpace(line))
+		}
+		fields = append(fields, headerField{Name: strings.TrimSpace(name), Raw: line})
+	}
+	return fields, msg[end+4:], nil
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// canonHeader canonicalizes a header field per RFC 6376 section 3.4.
+func canonHeader(h headerField, relaxed bool) string {
+	if !relaxed {
+		return h.Raw
+	}
+	value := strings.ReplaceAll(h.Value(), "\r\n", "")
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return strings.ToLower(h.Name) + ":" + value + "\r\n"
+}
+
+// canonBody canonicalizes a message body per RFC 6376 section 3.4.
+func canonBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if relaxed {
+		for i, l := range lines {
+			lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// ParseTags splits a tag=value list, as used by DKIM signatures and records.
+func ParseTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return tags
+}
+
+var sigValue = regexp.MustCompile(`(^|[;\s])b=[^;]*`)
+
+// stripSignature removes the value of the b= tag from a signature field.
+func stripSignature(h headerField) headerField {
+	name, value, _ := strings.Cut(h.Raw, ":")
+	value = sigValue.ReplaceAllString(value, "${1}b=")
+	if !strings.HasSuffix(value, "\r\n") {
+		value += "\r\n"
+	}
+	return headerField{Name: h.Name, Raw: name + ":" + value}
+}
+
+// selectHeaders picks the fields named by a signature's h= tag. Each name
+// selects the last instance of that field not already selected, and names
+// with no remaining instance select nothing.
+func selectHeaders(fields []headerField, names []string) []headerField {
+	used := make(map[int]bool)
+	out := make([]headerField, 0, len(names))
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].Name, name) {
+				used[i] = true
+				out = append(out, fields[i])
+				break
+			}
+		}
+	}
+	return out
+}
+
+// bodyHash computes the bh= value of a signature over `body`.
+func bodyHash(body []byte, relaxed bool, limit int) string {
+	canon := canonBody(body, relaxed)
+	if limit >= 0 && limit < len(canon) {
+		canon = canon[:limit]
+	}
+	sum := sha256.Sum256(canon)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHash hashes the selected header fields followed by the signature
+// field itself, with its signature removed and without its final CRLF.
+func headerHash(selected []headerField, sig headerField, relaxed bool) []byte {
+	h := sha256.New()
+	for _, f := range selected {
+		h.Write([]byte(canonHeader(f, relaxed)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(stripSignature(sig), relaxed), "\r\n")))
+	return h.Sum(nil)
+}
+
+// ParseDkimKey parses a PEM encoded RSA or Ed25519 private key, returning it
+// along with the signature algorithm it is used with.
+func ParseDkimKey(pkey []byte) (crypto.Signer, string, error) {
+	kb, _ := pem.Decode(pkey)
+	if kb == nil {
+		return nil, "", errors.New("could not decode DKIM key")
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(kb.Bytes)
+	if err != nil {
+		rpk, err := x509.ParsePKCS1PrivateKey(kb.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not parse DKIM key: %w", err)
+		}
+		pk = rpk
+	}
+	switch k := pk.(type) {
+	case *rsa.PrivateKey:
+		return k, AlgoRSASHA256, nil
+	case ed25519.PrivateKey:
+		return k, AlgoEd25519SHA256, nil
+	}
+	return nil, "", fmt.Errorf("unsupported DKIM key type %T", pk)
+}
+
+// signDigest signs a SHA-256 digest. As described in RFC 8463, Ed25519
+// signatures are made over the digest rather than the data itself.
+func signDigest(key crypto.Signer, digest []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return key.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// verifyDigest checks a signature made by signDigest.
+func verifyDigest(pub crypto.PublicKey, algo string, digest, sig []byte) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if algo != AlgoRSASHA256 {
+			return fmt.Errorf("%w: rsa key used for %s", ErrBadSignature, algo)
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) != nil {
+			return ErrBadSignature
+		}
+	case ed25519.PublicKey:
+		if algo != AlgoEd25519SHA256 {
+			return fmt.Errorf("%w: ed25519 key used for %s", ErrBadSignature, algo)
+		}
+		if !ed25519.Verify(k, digest, sig) {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	return nil
+}
+
+// lookupDkimKey retrieves the public key published at
+// <selector>._domainkey.<domain>.
+func lookupDkimKey(ctx context.Context, lookup func(context.Context, string) ([]string, error), selector, domain string) (crypto.PublicKey, error) {
+	if lookup == nil {
+		lookup = resolver.LookupTXT
+	}
+	name := selector + "._domainkey." + domain
+	records, err := lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("no key record at %s", name)
+	for _, record := range records {
+		var pub crypto.PublicKey
+		if pub, err = ParseDkimRecord(record); err == nil {
+			return pub, nil
+		}
+	}
+	return nil, err
+}
+
+// ParseDkimRecord parses the public key of a DKIM key record.
+func ParseDkimRecord(record string) (crypto.PublicKey, error) {
+	tags := ParseTags(record)
+	p := strings.Join(strings.Fields(tags["p"]), "")
+	if p == "" {
+		return nil, errors.New("key record has no key, it may have been revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key record: %w", err)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+			if rpk, ok := pub.(*rsa.PublicKey); ok {
+				return rpk, nil
+			}
+			return nil, errors.New("key record is not an rsa key")
+		}
+		return x509.ParsePKCS1PublicKey(der)
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key record")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", tags["k"])
+}
+
+// verifyMessageSignature checks a DKIM-Signature or ARC-Message-Signature
+// field against the message's header fields and body. The public key is
+// looked up with `lookup`, or taken from `pub` if it is set.
+func verifyMessageSignature(ctx context.Context, fields []headerField, body []byte, sig headerField, pub crypto.PublicKey, lookup func(context.Context, string) ([]string, error)) error {
+	tags := ParseTags(sig.Value())
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	limit := -1
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return fmt.Errorf("invalid l= tag %q", l)
+		}
+		limit = n
+	}
+	if bodyHash(body, bodyCanon == "relaxed", limit) != strings.Join(strings.Fields(tags["bh"]), "") {
+		return fmt.Errorf("%w: body hash mismatch", ErrBadSignature)
+	}
+
+	names := strings.Split(strings.Join(strings.Fields(tags["h"]), ""), ":")
+	digest := headerHash(selectHeaders(fields, names), sig, headerCanon == "relaxed")
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["b"]), ""))
+	if err != nil {
+		return fmt.Errorf("invalid b= tag: %w", err)
+	}
+	if pub == nil {
+		if pub, err = lookupDkimKey(ctx, lookup, tags["s"], tags["d"]); err != nil {
+			return err
+		}
+	}
+	return verifyDigest(pub, tags["a"], digest, b)
+}
+
+// dkimSignatures returns the DKIM-Signature fields of a message made for
+// `domain`, along with its header fields and body.
+func dkimSignatures(msg []byte, domain string) ([]headerField, []headerField, []byte, error) {
+	fields, body, err := splitMessage(msg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sigs := make([]headerField, 0)
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, "DKIM-Signature") && strings.EqualFold(ParseTags(f.Value())["d"], domain) {
+			sigs = append(sigs, f)
+		}
+	}
+	if len(sigs) == 0 {
+		return nil, nil, nil, fmt.Errorf("no DKIM signature for %s", domain)
+	}
+	return sigs, fields, body, nil
+}
+
+// verifySigned checks the DKIM signatures a message was given for `domain`
+// against the public keys of the selectors that made them.
+func verifySigned(msg []byte, domain string, pubs map[string]crypto.PublicKey) error {
+	sigs, fields, body, err := dkimSignatures(msg, domain)
+	if err != nil {
+		return err
+	}
+	for _, sig := range sigs {
+		selector := ParseTags(sig.Value())["s"]
+		pub, ok := pubs[selector]
+		if !ok {
+			continue
+		}
+		if err := verifyMessageSignature(context.Background(), fields, body, sig, pub, nil); err != nil {
+			return fmt.Errorf("DKIM signature with selector %s: %w", selector, err)
+		}
+		delete(pubs, selector)
+	}
+	for selector := range pubs {
+		return fmt.Errorf("no DKIM signature with selector %s", selector)
+	}
+	return nil
+}
+
+// DKIMVerifier checks signatures against the keys published for them in DNS.
+type DKIMVerifier struct {
+	// LookupTXT overrides the resolution of key records.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// Verify checks every DKIM signature of a message made for `domain` against
+// the key record at <selector>._domainkey.<domain>.
+func (v *DKIMVerifier) Verify(ctx context.Context, msg []byte, domain string) error {
+	sigs, fields, body, err := dkimSignatures(msg, domain)
+	if err != nil {
+		return err
+	}
+	for _, sig := range sigs {
+		if err := verifyMessageSignature(ctx, fields, body, sig, nil, v.LookupTXT); err != nil {
+			return fmt.Errorf("DKIM signature with selector %s: %w", ParseTags(sig.Value())["s"], err)
+		}
+	}
+	return nil
+}
+
+// VerifyDKIM checks the DKIM signatures of a message made for `domain`
+// against the keys published in DNS, using the default resolver.
+func VerifyDKIM(msg []byte, domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return (&DKIMVerifier{}).Verify(ctx, msg, domain)
+}
+
+// foldTags joins tag=value pairs into a header value, starting a new line
+// before each tag so that long signatures stay within line length limits.
+func foldTags(tags ...string) string {
+	return " " + strings.Join(tags, ";\r\n\t")
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVerifyDKIM(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DkimKeyCmd: writeKey(t, dir, "key.pem", key), DkimSelector: "sel"}
+
+	content := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: hi\r\n\r\nbody\r\n")
+	msg := ParseMessage(&content)
+	if err := SignMessage(msg, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// signatures are checked against the key which made them.
+	if err := verifySigned(*msg.Bytes, "example.com", map[string]crypto.PublicKey{"sel": other.Public()}); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("signature verified against the wrong key: %v", err)
+	}
+	if err := verifySigned(*msg.Bytes, "example.com", map[string]crypto.PublicKey{"missing": key.Public()}); err == nil {
+		t.Fatal("expected an error for a missing signature")
+	}
+
+	// and against the published record.
+	published := &DKIMVerifier{LookupTXT: staticTXT(map[string]string{
+		"sel._domainkey.example.com": dkimRecord(t, key.Public()),
+	})}
+	if err := published.Verify(context.Background(), *msg.Bytes, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	drifted := &DKIMVerifier{LookupTXT: staticTXT(map[string]string{
+		"sel._domainkey.example.com": dkimRecord(t, other.Public()),
+	})}
+	if err := drifted.Verify(context.Background(), *msg.Bytes, "example.com"); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("signature verified against a different published key: %v", err)
+	}
+	unpublished := &DKIMVerifier{LookupTXT: staticTXT(map[string]string{})}
+	if err := unpublished.Verify(context.Background(), *msg.Bytes, "example.com"); err == nil {
+		t.Fatal("signature verified without a published key")
+	}
+	if err := published.Verify(context.Background(), *msg.Bytes, "example.net"); err == nil {
+		t.Fatal("expected an error for a domain without signatures")
+	}
+}
+
+// TestCanonicalization checks the examples of RFC 6376 section 3.4.6.
+func TestCanonicalization(t *testing.T) {
+	fields, body, err := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relaxed, simple := "", ""
+	for _, f := range fields {
+		relaxed += canonHeader(f, true)
+		simple += canonHeader(f, false)
+	}
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("unexpected relaxed header canonicalization %q", relaxed)
+	}
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Fatalf("unexpected simple header canonicalization %q", simple)
+	}
+	if b := string(canonBody(body, true)); b != " C\r\nD E\r\n" {
+		t.Fatalf("unexpected relaxed body canonicalization %q", b)
+	}
+	if b := string(canonBody(body, false)); b != " C \r\nD \t E\r\n" {
+		t.Fatalf("unexpected simple body canonicalization %q", b)
+	}
+}
+
+// rfc8463Records are the key records of the examples in RFC 8463 appendix A.
+var rfc8463Records = map[string]string{
+	"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	"test._domainkey.football.example.com":     "v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB",
+}
+
+// TestRFC8463 checks the signed message of RFC 8463 appendix A. Both RSA and
+// Ed25519 signatures are deterministic, so signing it again with the example
+// keys must reproduce them exactly.
+func TestRFC8463(t *testing.T) {
+	msg, err := os.ReadFile("testdata/rfc8463.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &DKIMVerifier{LookupTXT: staticTXT(rfc8463Records)}
+	if err := verifier.Verify(context.Background(), msg, "football.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	pem, err := os.ReadFile("testdata/rfc8463-rsa.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, algo, err := ParseDkimKey(pem)
+	if err != nil || algo != AlgoRSASHA256 {
+		t.Fatalf("could not parse example key: %s %v", algo, err)
+	}
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	keys := map[string]crypto.Signer{"brisbane": ed25519.NewKeyFromSeed(seed), "test": rsaKey}
+
+	fields, body, err := splitMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh := bodyHash(body, true, -1); bh != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Fatalf("unexpected body hash %s", bh)
+	}
+	for _, sig := range fields[:2] {
+		tags := ParseTags(sig.Value())
+		names := strings.Split(strings.Join(strings.Fields(tags["h"]), ""), ":")
+		b, err := signDigest(keys[tags["s"]], headerHash(selectHeaders(fields, names), sig, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Join(strings.Fields(tags["b"]), ""); base64.StdEncoding.EncodeToString(b) != want {
+			t.Fatalf("signature with selector %s differs from the example", tags["s"])
+		}
+	}
+}
+
+// TestIndependentSignatures checks messages signed by another implementation,
+// github.com/toorop/go-dkim, with the RSA key of RFC 8463.
+func TestIndependentSignatures(t *testing.T) {
+	verifier := &DKIMVerifier{LookupTXT: staticTXT(rfc8463Records)}
+	for _, name := range []string{"go-dkim-relaxed.eml", "go-dkim-simple.eml"} {
+		msg, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifier.Verify(context.Background(), msg, "football.example.com"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		tampered := []byte(strings.Replace(string(msg), "hungry", "thirsty", 1))
+		if err := verifier.Verify(context.Background(), tampered, "football.example.com"); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("%s: modified message verified: %v", name, err)
+		}
+	}
+}
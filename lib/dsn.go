@@ -0,0 +1,199 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// DSN actions, as defined by RFC 3464.
+const (
+	ActionFailed  = "failed"
+	ActionDelayed = "delayed"
+)
+
+// StatusExpired is the status reported for recipients given up on once the
+// message has been queued too long.
+const StatusExpired = "4.4.7"
+
+// ErrNoNoticeTarget is returned by DeliverNotice when neither `DSNMaildir` nor
+// `DSNCommand` is configured.
+var ErrNoNoticeTarget = errors.New("no DSNMaildir or DSNCommand configured")
+
+// DSNRecipient is the delivery status of a single recipient.
+type DSNRecipient struct {
+	Recipient string
+	Action    string
+	// Status is the enhanced status code, e.g. "5.1.1".
+	Status string
+	// Diagnostic is the reply of the remote server, or a description of the
+	// failure if there was none.
+	Diagnostic string
+	RemoteMTA  string
+}
+
+// DSN is an RFC 3464 delivery status notification about a message, to be sent
+// to its sender.
+type DSN struct {
+	// ReportingMTA is the name of the host generating the report.
+	ReportingMTA string
+	Message      *ParsedMessage
+	Arrival      time.Time
+	Recipients   []DSNRecipient
+	// RetryUntil is when delivery will be given up on, for delay warnings.
+	RetryUntil time.Time
+}
+
+// replyCode matches the reply code and enhanced status code of an SMTP reply.
+var replyCode = regexp.MustCompile(`^([245])[0-9]{2}(?:[ -]([245]\.[0-9]{1,3}\.[0-9]{1,3}))?`)
+
+// ReplyStatus derives an enhanced status code from an SMTP reply. `fallback`
+// is returned for replies without a reply code, such as connection failures.
+func ReplyStatus(reply string, fallback string) string {
+	m := replyCode.FindStringSubmatch(reply)
+	if m == nil {
+		return fallback
+	}
+	if m[2] != "" {
+		return m[2]
+	}
+	return m[1] + ".0.0"
+}
+
+// NewDSNRecipients describes recipients which share an action, with the
+// server's reply for each. `fallback` is the status of those whose reply has
+// no status code.
+func NewDSNRecipients(replies map[string]string, action, fallback string) []DSNRecipient {
+	out := make([]DSNRecipient, 0, len(replies))
+	for rcpt, reply := range replies {
+		out = append(out, DSNRecipient{
+			Recipient:  rcpt,
+			Action:     action,
+			Status:     ReplyStatus(reply, fallback),
+			Diagnostic: reply,
+		})
+	}
+	return out
+}
+
+// Bytes renders the DSN as a multipart/report message.
+func (d *DSN) Bytes(now time.Time) ([]byte, error) {
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	delayed := true
+	for _, r := range d.Recipients {
+		if r.Action != ActionDelayed {
+			delayed = false
+		}
+	}
+	reporting := d.ReportingMTA
+	if reporting == "" {
+		reporting, _ = os.Hostname()
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	var human bytes.Buffer
+	if delayed {
+		fmt.Fprintf(&human, "Delivery of your message has been delayed to the following recipients.\r\n")
+		if !d.RetryUntil.IsZero() {
+			fmt.Fprintf(&human, "Delivery will continue to be attempted until %s.\r\n", d.RetryUntil.UTC().Format(time.RFC1123Z))
+		}
+		fmt.Fprintf(&human, "You do not need to resend it.\r\n\r\n")
+	} else {
+		fmt.Fprintf(&human, "Your message could not be delivered to the following recipients.\r\n\r\n")
+	}
+	for _, r := range d.Recipients {
+		diag := strings.ReplaceAll(strings.TrimSpace(r.Diagnostic), "\n", "\r\n    ")
+		fmt.Fprintf(&human, "  %s\r\n    %s\r\n", r.Recipient, diag)
+	}
+	part, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	part.Write(human.Bytes())
+
+	var status bytes.Buffer
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", reporting)
+	if !d.Arrival.IsZero() {
+		fmt.Fprintf(&status, "Arrival-Date: %s\r\n", d.Arrival.UTC().Format(time.RFC1123Z))
+	}
+	for _, r := range d.Recipients {
+		fmt.Fprintf(&status, "\r\nFinal-Recipient: rfc822; %s\r\n", r.Recipient)
+		fmt.Fprintf(&status, "Action: %s\r\n", r.Action)
+		fmt.Fprintf(&status, "Status: %s\r\n", r.Status)
+		if r.RemoteMTA != "" {
+			fmt.Fprintf(&status, "Remote-MTA: dns; %s\r\n", r.RemoteMTA)
+		}
+		if r.Diagnostic != "" {
+			diag := strings.Join(strings.Fields(r.Diagnostic), " ")
+			kind := "smtp"
+			if !replyCode.MatchString(r.Diagnostic) {
+				kind = "x-unix"
+			}
+			fmt.Fprintf(&status, "Diagnostic-Code: %s; %s\r\n", kind, diag)
+		}
+		if r.Action == ActionDelayed && !d.RetryUntil.IsZero() {
+			fmt.Fprintf(&status, "Will-Retry-Until: %s\r\n", d.RetryUntil.UTC().Format(time.RFC1123Z))
+		}
+	}
+	part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	part.Write(status.Bytes())
+
+	if d.Message != nil && d.Message.Bytes != nil {
+		if end := bytes.Index(*d.Message.Bytes, []byte("\r\n\r\n")); end != -1 {
+			part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+			part.Write((*d.Message.Bytes)[:end+2])
+		}
+	}
+	w.Close()
+
+	subject := "Undelivered Mail Returned to Sender"
+	if delayed {
+		subject = "Delayed Mail (still being retried)"
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", d.Message.SourceDomain)
+	fmt.Fprintf(&out, "To: %s\r\n", d.Message.Sender)
+	fmt.Fprintf(&out, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&out, "Date: %s\r\n", now.UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <%s@%s>\r\n", id, d.Message.SourceDomain)
+	fmt.Fprintf(&out, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", w.Boundary())
+	fmt.Fprintf(&out, "\r\n")
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// DeliverNotice delivers a notification such as a DSN into the local Maildir
+// configured by `DSNMaildir`, or else passes it on stdin to the command
+// configured by `DSNCommand`. Notices have a null reverse-path: the Maildir
+// copy carries an empty Return-Path, and the command is told to send with
+// NullSender through the sender options of sendmail and signmail.
+func DeliverNotice(msg []byte) error {
+	if dir := viper.GetString("DSNMaildir"); dir != "" {
+		_, err := DeliverMaildir(dir, append([]byte("Return-Path: "+NullSender+"\r\n"), msg...), "")
+		return err
+	}
+	if cmdLine := viper.GetString("DSNCommand"); cmdLine != "" {
+		args := strings.Split(cmdLine, " ")
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "GOSENDMAIL_SENDER="+NullSender, "GOSENDMAIL_FROM="+NullSender)
+		cmd.Stdin = bytes.NewReader(msg)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w", out, err)
+		}
+		return nil
+	}
+	return ErrNoNoticeTarget
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestReplyStatus(t *testing.T) {
+	cases := map[string]string{
+		"550 5.1.1 <bob@example.com>: user unknown": "5.1.1",
+		"452-4.2.2 mailbox full":                    "4.2.2",
+		"554 rejected":                              "5.0.0",
+		"dial tcp: connection refused":              "4.0.0",
+	}
+	for reply, status := range cases {
+		if got := ReplyStatus(reply, "4.0.0"); got != status {
+			t.Errorf("status of %q: got %s, want %s", reply, got, status)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	content := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: hi\r\n\r\nbody\r\n")
+	msg := ParseMessage(&content)
+	dsn := DSN{
+		ReportingMTA: "mx.example.com",
+		Message:      &msg,
+		Arrival:      time.Now(),
+		Recipients: NewDSNRecipients(map[string]string{
+			"bob@example.org": "550 5.1.1 user unknown",
+		}, ActionFailed, "5.0.0"),
+	}
+	notice, err := dsn.Bytes(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(notice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("To") != "alice@example.com" {
+		t.Fatalf("notice addressed to %q", m.Header.Get("To"))
+	}
+	reply := ParseMessage(&notice)
+	if err := reply.SetSender(NullSender); err != nil || reply.Sender != "" || reply.SourceDomain != "example.com" {
+		t.Fatalf("unexpected null sender %q of %q: %v", reply.Sender, reply.SourceDomain, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type %q: %v", m.Header.Get("Content-Type"), err)
+	}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	types := []string{}
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, part.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Type") == "message/delivery-status" {
+			for _, field := range []string{"Reporting-MTA: dns; mx.example.com", "Final-Recipient: rfc822; bob@example.org", "Action: failed", "Status: 5.1.1", "Diagnostic-Code: smtp; 550 5.1.1 user unknown"} {
+				if !strings.Contains(string(body), field) {
+					t.Errorf("delivery status lacks %q:\n%s", field, body)
+				}
+			}
+		}
+	}
+	if len(types) != 3 || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("unexpected parts %v", types)
+	}
+
+	// notices are delivered to a configured maildir.
+	dir := path.Join(t.TempDir(), "Maildir")
+	viper.Set("DSNMaildir", dir)
+	defer viper.Reset()
+	if err := DeliverNotice(notice); err != nil {
+		t.Fatal(err)
+	}
+	delivered, _ := filepath.Glob(path.Join(dir, "new", "*"))
+	if len(delivered) != 1 {
+		t.Fatalf("expected 1 delivered notice, found %v", delivered)
+	}
+	if stored, _ := os.ReadFile(delivered[0]); !bytes.Equal(stored, append([]byte("Return-Path: <>\r\n"), notice...)) {
+		t.Fatal("delivered notice differs")
+	}
+	if left, _ := os.ReadDir(path.Join(dir, "tmp")); len(left) != 0 {
+		t.Fatal("temporary file left in maildir")
+	}
+}
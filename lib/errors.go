@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+)
+
+// Stage identifies the step of an SMTP transaction during which delivery failed.
+type Stage string
+
+// The stages of delivery to a remote mail server.
+const (
+	StageConnect  Stage = "connect"
+	StageHello    Stage = "HELO"
+	StageStartTLS Stage = "STARTTLS"
+	StageMail     Stage = "MAIL"
+	StageRcpt     Stage = "RCPT"
+	StageData     Stage = "DATA"
+)
+
+var enhancedCodeRegexp = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}`)
+
+// DeliveryError describes a failure to deliver a message to a destination domain.
+type DeliveryError struct {
+	Domain string
+	// Host is the MX host being spoken to, if a connection was established.
+	Host  string
+	Stage Stage
+	// Code is the SMTP reply code from the server, or 0 if there was no reply.
+	Code int
+	// EnhancedCode is the RFC 3463 status code (e.g. "5.1.1") if the server gave one.
+	EnhancedCode string
+	// Temporary failures may succeed if retried later.
+	Temporary bool
+	Err       error
+}
+
+// NewDeliveryError classifies an error encountered at a given stage of delivery.
+func NewDeliveryError(domain, host string, stage Stage, err error) *DeliveryError {
+	de := &DeliveryError{
+		Domain:    domain,
+		Host:      host,
+		Stage:     stage,
+		Err:       err,
+		Temporary: true,
+	}
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		de.Code = tpErr.Code
+		de.EnhancedCode = enhancedCodeRegexp.FindString(tpErr.Msg)
+		de.Temporary = tpErr.Code < 500
+	} else if errors.Is(err, ErrNullMX) {
+		de.Temporary = false
+	}
+	return de
+}
+
+func (e *DeliveryError) Error() string {
+	kind := "permanent"
+	if e.Temporary {
+		kind = "temporary"
+	}
+	if e.Host != "" {
+		return fmt.Sprintf("%s failure delivering to %s via %s at %s: %v", kind, e.Domain, e.Host, e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s failure delivering to %s at %s: %v", kind, e.Domain, e.Stage, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
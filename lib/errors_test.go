@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+)
+
+func TestDeliveryError(t *testing.T) {
+	de := NewDeliveryError("example.com", "mx.example.com", StageRcpt,
+		&textproto.Error{Code: 550, Msg: "5.1.1 no such user"})
+	if de.Temporary || de.Code != 550 || de.EnhancedCode != "5.1.1" {
+		t.Fatalf("unexpected classification: %+v", de)
+	}
+
+	de = NewDeliveryError("example.com", "mx.example.com", StageMail,
+		&textproto.Error{Code: 451, Msg: "4.7.1 greylisted"})
+	if !de.Temporary || de.EnhancedCode != "4.7.1" {
+		t.Fatalf("unexpected classification: %+v", de)
+	}
+
+	de = NewDeliveryError("example.com", "", StageConnect, ErrNullMX)
+	if de.Temporary || !errors.Is(de, ErrNullMX) {
+		t.Fatalf("null mx should be a permanent failure: %+v", de)
+	}
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// Event types emitted by `sendmail` when run with GOSENDMAIL_FORMAT=json.
+const (
+	EventConnect      = "connect"
+	EventTLS          = "tls-established"
+	EventRcptAccepted = "rcpt-accepted"
+	EventRcptRejected = "rcpt-rejected"
+	EventDelivered    = "delivered"
+	EventDeferred     = "deferred"
+	EventFailed       = "failed"
+)
+
+// Event is a single newline-delimited JSON record of delivery progress, passed
+// from `sendmail` to the commanding `signmail` process.
+type Event struct {
+	Event      string   `json:"event"`
+	Domain     string   `json:"domain,omitempty"`
+	Host       string   `json:"host,omitempty"`
+	Addr       string   `json:"addr,omitempty"`
+	Recipient  string   `json:"recipient,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+
+	// Failure details
+	Stage        Stage  `json:"stage,omitempty"`
+	Code         int    `json:"code,omitempty"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+	Temporary    bool   `json:"temporary,omitempty"`
+	Reply        string `json:"reply,omitempty"`
+
+	// TLS details
+	Encrypted    bool   `json:"encrypted,omitempty"`
+	TLSVersion   string `json:"tls_version,omitempty"`
+	Cipher       string `json:"cipher,omitempty"`
+	PeerCert     string `json:"peer_cert,omitempty"`
+	PeerCertHash string `json:"peer_cert_sha256,omitempty"`
+}
+
+// FailureEvent creates an event of a given type describing a delivery error.
+func FailureEvent(event string, rcpt string, de *DeliveryError) Event {
+	ev := Event{Event: event, Recipient: rcpt}
+	if de != nil {
+		ev.Domain = de.Domain
+		ev.Host = de.Host
+		ev.Stage = de.Stage
+		ev.Code = de.Code
+		ev.EnhancedCode = de.EnhancedCode
+		ev.Temporary = de.Temporary
+		ev.Reply = de.Err.Error()
+	}
+	return ev
+}
+
+// ResultEvents describes the outcome of a call to `SendTo` as a sequence of events.
+func ResultEvents(recipients []string, result *DeliveryResult, err error) []Event {
+	events := make([]Event, 0, 3+len(recipients))
+	if result.Host != "" {
+		events = append(events, Event{Event: EventConnect, Domain: result.Domain, Host: result.Host, Addr: result.Addr})
+	}
+	if result.TLS != nil {
+		ev := Event{
+			Event:      EventTLS,
+			Domain:     result.Domain,
+			Host:       result.Host,
+			TLSVersion: tls.VersionName(result.TLS.Version),
+			Cipher:     tls.CipherSuiteName(result.TLS.CipherSuite),
+		}
+		if len(result.TLS.PeerCertificates) > 0 {
+			leaf := result.TLS.PeerCertificates[0]
+			sum := sha256.Sum256(leaf.Raw)
+			ev.PeerCert = leaf.Subject.String()
+			ev.PeerCertHash = hex.EncodeToString(sum[:])
+		}
+		events = append(events, ev)
+	}
+	for _, rcpt := range result.Accepted {
+		events = append(events, Event{Event: EventRcptAccepted, Domain: result.Domain, Host: result.Host, Recipient: rcpt})
+	}
+
+	if err != nil {
+		de, _ := err.(*DeliveryError)
+		if de == nil {
+			de = NewDeliveryError(result.Domain, result.Host, StageConnect, err)
+		}
+		events = append(events, FailureEvent(EventFailed, "", de))
+		for _, rcpt := range recipients {
+			if _, ok := result.Failed[rcpt]; ok {
+				continue
+			}
+			if de.Temporary {
+				events = append(events, FailureEvent(EventDeferred, rcpt, de))
+			} else {
+				events = append(events, FailureEvent(EventRcptRejected, rcpt, de))
+			}
+		}
+	} else if len(result.Accepted) > 0 {
+		events = append(events, Event{
+			Event:      EventDelivered,
+			Domain:     result.Domain,
+			Host:       result.Host,
+			Recipients: result.Accepted,
+			Encrypted:  result.Encrypted,
+			TLSVersion: result.TLSVersion,
+			Cipher:     result.TLSCipher,
+		})
+	}
+
+	for _, rcpt := range recipients {
+		de, ok := result.Failed[rcpt]
+		if !ok {
+			continue
+		}
+		if de.Temporary {
+			events = append(events, FailureEvent(EventDeferred, rcpt, de))
+		} else {
+			events = append(events, FailureEvent(EventRcptRejected, rcpt, de))
+		}
+	}
+	return events
+}
+
+// InterpretEvents applies the newline-delimited JSON events output by a
+// `sendmail` command to a ParsedMessage, in the same manner as `InterpretLog`.
+// It returns false if no events were found, which indicates an older `sendmail`
+// that only speaks the text protocol.
+func InterpretEvents(l string, parsed *ParsedMessage) bool {
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(l))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		ev := Event{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Event == "" {
+			continue
+		}
+		found = true
+
+		switch ev.Event {
+		case EventDelivered:
+			parsed.RemoveRecipients(strings.Join(ev.Recipients, ", "))
+		case EventRcptRejected:
+			if parsed.Rejected == nil {
+				parsed.Rejected = make(map[string]string)
+			}
+			parsed.Rejected[ev.Recipient] = ev.Reply
+			parsed.RemoveRecipients(ev.Recipient)
+		case EventDeferred:
+			if parsed.Deferred == nil {
+				parsed.Deferred = make(map[string]string)
+			}
+			parsed.Deferred[ev.Recipient] = ev.Reply
+		}
+	}
+	return found
+}
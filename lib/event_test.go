@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/textproto"
+	"testing"
+)
+
+func TestEventRoundTrip(t *testing.T) {
+	m := ParsedMessage{}
+	if err := m.SetRecipients("a@gmail.com, typo@gmail.com, b@gmail.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	result := &DeliveryResult{
+		Domain:   "gmail.com",
+		Host:     "mx.gmail.com",
+		Accepted: []string{"a@gmail.com"},
+		Failed: map[string]*DeliveryError{
+			"typo@gmail.com": NewDeliveryError("gmail.com", "mx.gmail.com", StageRcpt, &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}),
+			"b@gmail.com":    NewDeliveryError("gmail.com", "mx.gmail.com", StageRcpt, &textproto.Error{Code: 452, Msg: "4.2.2 mailbox full"}),
+		},
+	}
+
+	var out bytes.Buffer
+	out.WriteString("Warning: Permanently added 'myserver' to the list of known hosts.\n")
+	enc := json.NewEncoder(&out)
+	for _, ev := range ResultEvents(m.Rcpt["gmail.com"], result, nil) {
+		if err := enc.Encode(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// partial trailing line
+	out.WriteString(`{"event":"deliv`)
+
+	if !InterpretEvents(out.String(), &m) {
+		t.Fatal("events not recognized")
+	}
+	if m.Recipients() != "b@gmail.com" {
+		t.Fatalf("unexpected remaining recipients: %s", m.Recipients())
+	}
+	if _, ok := m.Rejected["typo@gmail.com"]; !ok {
+		t.Fatalf("rejection not recorded: %v", m.Rejected)
+	}
+	if _, ok := m.Deferred["b@gmail.com"]; !ok {
+		t.Fatalf("deferral not recorded: %v", m.Deferred)
+	}
+
+	if InterpretEvents("2024/01/17 10:00:01 Delivered: b@gmail.com\n", &m) {
+		t.Fatal("text protocol mistaken for events")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package lib
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, where processes sharing a
+// file are not kept from modifying it at once.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
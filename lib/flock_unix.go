@@ -0,0 +1,23 @@
+//go:build unix
+
+package lib
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for an advisory lock on `f`, held exclusively or shared with
+// other holders of a shared lock.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+// unlockFile releases the lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,303 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// KeyAgent, when set, holds DKIM keys and makes signatures in place of
+// running the key command of each signing key for every message.
+var KeyAgent *KeyAgentClient
+
+// ErrAgentRunning is returned by ListenKeyAgent when another agent is already
+// listening on the socket.
+var ErrAgentRunning = errors.New("a key agent is already running")
+
+// errUnknownKey is reported by the agent for keys it has not been given.
+const errUnknownKey = "unknown key"
+
+// agentStartTimeout bounds how long to wait for a newly started agent.
+const agentStartTimeout = 5 * time.Second
+
+// agentRequest is a request to the key agent. Keys are identified by the key
+// command which outputs them, which the agent runs itself on an "add".
+type agentRequest struct {
+	// Op is one of "add", "public", "sign" or "flush".
+	Op     string
+	KeyCmd string
+	Digest []byte `json:",omitempty"`
+}
+
+type agentResponse struct {
+	Algo      string `json:",omitempty"`
+	Public    []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// KeyAgentServer holds decrypted DKIM keys in memory, signing digests with
+// them for clients connecting over a unix socket. Keys are read by running
+// their key commands in the agent, and never leave it.
+type KeyAgentServer struct {
+	// Idle is how long the agent waits without requests before exiting. Zero
+	// waits forever.
+	Idle time.Duration
+
+	mu   sync.Mutex
+	keys map[string]agentKey
+}
+
+type agentKey struct {
+	signer crypto.Signer
+	algo   string
+}
+
+// ListenKeyAgent listens on the unix socket at `path`, accessible only to
+// the current user. The socket's directory is created if needed, and must not
+// be accessible to other users, so that the socket is never exposed before
+// its permissions are restricted. A socket left behind by an agent which has
+// exited is replaced.
+func ListenKeyAgent(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key agent directory %s must only be accessible to its owner", dir)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, ErrAgentRunning
+	}
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve answers requests on `l` until the agent has been idle for Idle.
+// Requests in progress are answered before it returns.
+func (a *KeyAgentServer) Serve(l net.Listener) error {
+	conns := make(chan net.Conn)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var idle <-chan time.Time
+	var timer *time.Timer
+	if a.Idle > 0 {
+		timer = time.NewTimer(a.Idle)
+		defer timer.Stop()
+		idle = timer.C
+	}
+	for {
+		select {
+		case conn := <-conns:
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(a.Idle)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.handle(conn)
+			}()
+		case err := <-errs:
+			return err
+		case <-idle:
+			l.Close()
+			// answer connections accepted meanwhile, until the accept loop
+			// sees the listener closed.
+			for {
+				select {
+				case conn := <-conns:
+					a.handle(conn)
+				case <-errs:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (a *KeyAgentServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	resp := a.answer(&req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (a *KeyAgentServer) answer(req *agentRequest) *agentResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.keys == nil || req.Op == "flush" {
+		a.keys = make(map[string]agentKey)
+	}
+	switch req.Op {
+	case "flush":
+		return &agentResponse{}
+	case "add":
+		pkey, err := loadDkimKey(req.KeyCmd)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		signer, algo, err := ParseDkimKey(pkey)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		a.keys[req.KeyCmd] = agentKey{signer, algo}
+	}
+
+	key, ok := a.keys[req.KeyCmd]
+	if !ok {
+		return &agentResponse{Error: errUnknownKey}
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.signer.Public())
+	if err != nil {
+		return &agentResponse{Error: err.Error()}
+	}
+	resp := &agentResponse{Algo: key.algo, Public: pub}
+	if req.Op == "sign" {
+		if resp.Signature, err = signDigest(key.signer, req.Digest); err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+	}
+	return resp
+}
+
+// KeyAgentClient signs with keys held by a KeyAgentServer.
+type KeyAgentClient struct {
+	// Path is the unix socket the agent listens on.
+	Path string
+	// Start launches an agent when none is listening on Path.
+	Start func() error
+}
+
+func (c *KeyAgentClient) dial() (net.Conn, error) {
+	conn, err := net.Dial("unix", c.Path)
+	if err == nil || c.Start == nil {
+		return conn, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("could not start key agent: %w", err)
+	}
+	deadline := time.Now().Add(agentStartTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if conn, err = net.Dial("unix", c.Path); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("key agent did not start: %w", err)
+}
+
+func (c *KeyAgentClient) call(req *agentRequest) (*agentResponse, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("key agent closed the connection")
+		}
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Signer returns a signer for the key output by `keyCmd`, along with its
+// signature algorithm. If the agent does not hold the key already, it runs
+// the key command itself, so that the key is never seen by the client.
+func (c *KeyAgentClient) Signer(keyCmd string) (crypto.Signer, string, error) {
+	resp, err := c.call(&agentRequest{Op: "public", KeyCmd: keyCmd})
+	if err == nil && resp.Error == errUnknownKey {
+		resp, err = c.call(&agentRequest{Op: "add", KeyCmd: keyCmd})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.Error != "" {
+		return nil, "", fmt.Errorf("key agent: %s", resp.Error)
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.Public)
+	if err != nil {
+		return nil, "", err
+	}
+	return &agentSigner{client: c, keyCmd: keyCmd, pub: pub}, resp.Algo, nil
+}
+
+// Flush has the agent forget the keys it holds, so that they are read again
+// from their key commands, e.g. once they have been rotated. Nothing needs to
+// be done if no agent is running.
+func (c *KeyAgentClient) Flush() error {
+	resp, err := (&KeyAgentClient{Path: c.Path}).call(&agentRequest{Op: "flush"})
+	if errors.Is(err, os.ErrNotExist) || isConnRefused(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("key agent: %s", resp.Error)
+	}
+	return nil
+}
+
+// agentSigner is a crypto.Signer making DKIM signatures through the agent.
+type agentSigner struct {
+	client *KeyAgentClient
+	keyCmd string
+	pub    crypto.PublicKey
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs a SHA-256 digest as signDigest would with the key itself.
+func (s *agentSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	resp, err := s.client.call(&agentRequest{Op: "sign", KeyCmd: s.keyCmd, Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("key agent: %s", resp.Error)
+	}
+	return resp.Signature, nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package lib
+
+// isConnRefused reports no refused connections on platforms where they are
+// not distinguished, so that a stale agent socket is reported as an error.
+func isConnRefused(err error) bool {
+	return false
+}
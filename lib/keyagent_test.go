@@ -0,0 +1,114 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyAgent(t *testing.T) {
+	// unix socket paths are limited in length, so avoid t.TempDir.
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "agent.sock")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DkimKeys: []DkimKey{
+		{KeyCmd: writeKey(t, dir, "rsa.pem", rsaKey), Selector: "rsa"},
+		{KeyCmd: writeKey(t, dir, "ed.pem", edKey), Selector: "ed"},
+	}}
+
+	// the agent is started on first use.
+	done := make(chan error, 1)
+	KeyAgent = &KeyAgentClient{Path: socket, Start: func() error {
+		l, err := ListenKeyAgent(socket)
+		if err != nil {
+			return err
+		}
+		go func() {
+			done <- (&KeyAgentServer{Idle: 500 * time.Millisecond}).Serve(l)
+		}()
+		return nil
+	}}
+	defer func() { KeyAgent = nil }()
+
+	content := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: hi\r\n\r\nbody\r\n")
+	msg := ParseMessage(&content)
+	if err := SignMessage(msg, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(*msg.Bytes), "DKIM-Signature:"); n != 2 {
+		t.Fatalf("expected 2 signatures, found %d", n)
+	}
+	if _, err := ListenKeyAgent(socket); !errors.Is(err, ErrAgentRunning) {
+		t.Fatalf("expected the running agent to be detected: %v", err)
+	}
+
+	// once held by the agent, keys are not read again.
+	os.Remove(path.Join(dir, "rsa.pem"))
+	os.Remove(path.Join(dir, "ed.pem"))
+	content = []byte("From: alice@example.com\r\nTo: carol@example.org\r\nSubject: again\r\n\r\nbody\r\n")
+	msg = ParseMessage(&content)
+	if err := SignMessage(msg, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// once flushed, keys are read from their key commands again.
+	if err := KeyAgent.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	content = []byte("From: alice@example.com\r\nTo: dave@example.org\r\nSubject: rotated\r\n\r\nbody\r\n")
+	msg = ParseMessage(&content)
+	if err := SignMessage(msg, cfg); err == nil {
+		t.Fatal("expected flushed keys to be read again")
+	}
+
+	// the agent exits once idle.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not exit when idle")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatal("agent socket left behind")
+	}
+	if err := KeyAgent.Flush(); err != nil {
+		t.Fatalf("flushing a stopped agent: %v", err)
+	}
+
+	// the socket is only created in a private directory.
+	shared := path.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenKeyAgent(path.Join(shared, "agent.sock")); err == nil {
+		t.Fatal("expected a socket in a shared directory to be refused")
+	}
+	l, err := ListenKeyAgent(path.Join(dir, "private", "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if info, err := os.Stat(path.Join(dir, "private")); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("unexpected socket directory: %v %v", info, err)
+	}
+}
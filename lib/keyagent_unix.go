@@ -0,0 +1,14 @@
+//go:build unix
+
+package lib
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused indicates if dialing the agent failed because nothing is
+// listening on its socket, as is the case once an agent has exited.
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
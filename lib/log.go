@@ -1,24 +1,44 @@
 package lib
 
 import (
+	"regexp"
 	"strings"
 )
 
+// logPrefix matches the timestamp the standard `log` package prepends to lines.
+var logPrefix = regexp.MustCompile(`^[0-9]{4}/[0-9]{2}/[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)? `)
+
 // InterpretLog matches the output of a `sendmail` command
 // for a given ParsedMessage. Output lines indicating the
 // message was delivered are used to remove remaining recipients
-// where redelivery is needed.
+// where redelivery is needed. Recipients which were permanently
+// rejected are removed and recorded in `parsed.Rejected`, while
+// temporary failures are recorded in `parsed.Deferred`.
 func InterpretLog(l string, parsed *ParsedMessage) {
 	lines := strings.Split(l, "\n")
 	for _, line := range lines {
+		line = logPrefix.ReplaceAllString(strings.TrimRight(line, "\r"), "")
 		if strings.HasPrefix(line, "Fatal") {
 			return
-		} else if strings.HasPrefix(line, "Info") {
+		} else if strings.HasPrefix(line, "Info") || strings.HasPrefix(line, "Failed:") {
 			continue
 		} else if strings.HasPrefix(line, "Delivered:") {
 			// remove rcpts. from parsed.
 			rcpts := line[10:]
 			parsed.RemoveRecipients(rcpts)
+		} else if strings.HasPrefix(line, "Rejected:") {
+			rcpt, reply, _ := strings.Cut(strings.TrimSpace(line[9:]), ": ")
+			if parsed.Rejected == nil {
+				parsed.Rejected = make(map[string]string)
+			}
+			parsed.Rejected[rcpt] = reply
+			parsed.RemoveRecipients(rcpt)
+		} else if strings.HasPrefix(line, "Deferred:") {
+			rcpt, reply, _ := strings.Cut(strings.TrimSpace(line[9:]), ": ")
+			if parsed.Deferred == nil {
+				parsed.Deferred = make(map[string]string)
+			}
+			parsed.Deferred[rcpt] = reply
 		}
 	}
 }
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var maildirCounter uint64
+
+// DeliverMaildir stores a message in the Maildir at `dir`, creating it if
+// needed. The message is written to `tmp` and then moved into place, so that
+// readers never see it partially written. Without `flags` the message is
+// delivered to `new`, as an unread arrival; with flags (e.g. "S" for seen) it
+// is placed directly in `cur` carrying them. The path of the delivered message
+// is returned.
+func DeliverMaildir(dir string, msg []byte, flags string) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// '/' and ':' may not appear in maildir names.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirCounter, 1), host)
+
+	tmp := path.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	dest := path.Join(dir, "new", name)
+	if flags != "" {
+		dest = path.Join(dir, "cur", name+":2,"+flags)
+	}
+	if err := os.Link(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dest, os.Remove(tmp)
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDeliverMaildir(t *testing.T) {
+	dir := path.Join(t.TempDir(), "Sent")
+	msg := []byte("From: alice@example.com\r\n\r\nbody\r\n")
+
+	first, err := DeliverMaildir(dir, msg, "S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Dir(first) != path.Join(dir, "cur") || !strings.HasSuffix(first, ":2,S") {
+		t.Fatalf("flagged message delivered to %s", first)
+	}
+	if stored, _ := os.ReadFile(first); !bytes.Equal(stored, msg) {
+		t.Fatal("stored message differs")
+	}
+
+	second, err := DeliverMaildir(dir, msg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Dir(second) != path.Join(dir, "new") || path.Base(second) == strings.TrimSuffix(path.Base(first), ":2,S") {
+		t.Fatalf("unexpected second delivery %s", second)
+	}
+	if left, _ := os.ReadDir(path.Join(dir, "tmp")); len(left) != 0 {
+		t.Fatal("temporary file left in maildir")
+	}
+}
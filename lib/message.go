@@ -3,9 +3,11 @@ package lib
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/mail"
@@ -53,15 +55,31 @@ func ReadMessage(reader io.Reader) []byte {
 
 // ParsedMessage represents a semi-structred email message.
 type ParsedMessage struct {
+	// ID uniquely identifies the message while it is queued.
+	ID           string
 	Sender       string
 	SourceDomain string
 	Rcpt         map[string][]string
 	DestDomain   []string
 	Bytes        *[]byte
+	// Rejected maps recipients refused permanently to the server's reply.
+	Rejected map[string]string
+	// Deferred maps recipients which failed temporarily to the reason given.
+	Deferred map[string]string
 	*mail.Message
 }
 
-// Hash provides an ideally stable handle for a message.
+// NewID generates a new unique message ID.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating message id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash provides a fingerprint of the message body. Messages with identical
+// bodies share a hash, so it does not identify a message; see `ID`.
 func (p ParsedMessage) Hash() string {
 	hasher := sha256.New()
 
@@ -77,17 +95,20 @@ func (p ParsedMessage) Hash() string {
 
 // FileName provides a stable location on disk for the message to serialize to.
 func (p ParsedMessage) FileName() string {
-	return path.Join(path.Dir(viper.ConfigFileUsed()), p.Hash()+".eml")
+	return path.Join(path.Dir(viper.ConfigFileUsed()), p.ID+".eml")
 }
 
 // UnmarshalText attempts to load a message from a textual pointer of its state.
+// Handles written by earlier versions hold the message hash in place of its ID,
+// which continues to be used as the ID of those messages.
 func (p *ParsedMessage) UnmarshalText(b []byte) error {
-	// attempt loading file from hash.
-	hash := bytes.Index(b, []byte(" "))
-	if hash == -1 {
+	// attempt loading file from id.
+	id := bytes.Index(b, []byte(" "))
+	if id < 1 || bytes.ContainsAny(b[0:id], "/\\") {
 		return errors.New("invalid cache line")
 	}
-	filename := path.Join(path.Dir(viper.ConfigFileUsed()), string(b[0:hash])+".eml")
+	p.ID = string(b[0:id])
+	filename := p.FileName()
 
 	dat, err := ParseDiskInput(filename)
 	if err != nil {
@@ -101,20 +122,26 @@ func (p *ParsedMessage) UnmarshalText(b []byte) error {
 	p.Message = msg.Message
 
 	// set recipients.
-	return p.SetRecipients(string(b[hash+1:]))
+	return p.SetRecipients(string(b[id+1:]))
 }
 
 // MarshalText provides a textual handle of the message. The message contents is
 // not included, and must be saved using `Save` for the marshal'ed handle to be
 // considered durable.
 func (p ParsedMessage) MarshalText() ([]byte, error) {
-	// line format: <hash> <rcpts>
-	return []byte(p.Hash() + " " + p.Recipients()), nil
+	// line format: <id> <rcpts>
+	if p.ID == "" {
+		return nil, errors.New("message has no id")
+	}
+	return []byte(p.ID + " " + p.Recipients()), nil
 }
 
-// Save message to disk.
-// TODO: support encryption of on-disk data.
+// Save message to disk, encrypted as configured by `QueueRecipient` or
+// `WriteToDisk`.
 func (p *ParsedMessage) Save() error {
+	if p.ID == "" {
+		return errors.New("message has no id")
+	}
 	return WriteDiskOutput(p.FileName(), *p.Bytes)
 }
 
@@ -157,7 +184,12 @@ func ParseMessage(msg *[]byte) ParsedMessage {
 	}
 	defaultReceipients := joinAddresses(addrs)
 
+	id, err := NewID()
+	if err != nil {
+		log.Fatal(err)
+	}
 	pm := ParsedMessage{
+		ID:           id,
 		Sender:       sender.Address,
 		SourceDomain: fromHost,
 		Message:      m,
@@ -168,8 +200,18 @@ func ParseMessage(msg *[]byte) ParsedMessage {
 	return pm
 }
 
+// NullSender is the reverse-path given for messages, such as delivery status
+// notifications, which must not themselves be answered (RFC 5321 section 4.5.5).
+const NullSender = "<>"
+
 // SetSender specifies an explicit sending email account for the message.
+// With NullSender the message is sent with an empty reverse-path, while its
+// source domain remains that of its From header.
 func (p *ParsedMessage) SetSender(sender string) error {
+	if sender == NullSender {
+		p.Sender = ""
+		return nil
+	}
 	_, fromHost := splitAddress(sender)
 	p.Sender = sender
 	p.SourceDomain = fromHost
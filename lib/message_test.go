@@ -67,3 +67,26 @@ func TestSerialize(t *testing.T) {
 		t.Fatalf("Failed to recover message recipients")
 	}
 }
+
+func TestInterpretLog(t *testing.T) {
+	m := ParsedMessage{}
+	if err := m.SetRecipients("a@gmail.com, typo@gmail.com, c@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	out := "2024/01/17 10:00:00 Info: connecting to gmail.com\n" +
+		"2024/01/17 10:00:01 Delivered: a@gmail.com\n" +
+		"2024/01/17 10:00:01 Rejected: typo@gmail.com: 550 5.1.1 no such user\n" +
+		"2024/01/17 10:00:02 Deferred: c@example.com: 451 4.7.1 try again later\n" +
+		"2024/01/17 10:00:02 Fatal: delivery failed for 2 recipients\n"
+	InterpretLog(out, &m)
+
+	if m.Recipients() != "c@example.com" {
+		t.Fatalf("unexpected remaining recipients: %s", m.Recipients())
+	}
+	if m.Rejected["typo@gmail.com"] != "550 5.1.1 no such user" {
+		t.Fatalf("rejection not recorded: %v", m.Rejected)
+	}
+	if _, ok := m.Deferred["c@example.com"]; !ok {
+		t.Fatalf("deferral not recorded: %v", m.Deferred)
+	}
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MTA-STS policy modes.
+const (
+	STSModeEnforce = "enforce"
+	STSModeTesting = "testing"
+	STSModeNone    = "none"
+)
+
+// maxSTSPolicySize bounds the size of a policy fetched from a remote server.
+const maxSTSPolicySize = 64 * 1024
+
+// ErrSTSNoMX is returned when none of a domain's MX hosts are permitted by its
+// MTA-STS policy.
+var ErrSTSNoMX = errors.New("no mx host permitted by mta-sts policy")
+
+// STSPolicy is an MTA-STS policy (RFC 8461) published by a destination domain.
+type STSPolicy struct {
+	Version string
+	Mode    string
+	MX      []string
+	MaxAge  int
+	// ID is the policy id from the domain's _mta-sts TXT record.
+	ID string
+	// Fetched is when the policy was retrieved.
+	Fetched time.Time
+}
+
+// ParseSTSPolicy parses the body of a `.well-known/mta-sts.txt` policy file.
+func ParseSTSPolicy(body []byte) (*STSPolicy, error) {
+	p := STSPolicy{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			p.Version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_age: %w", err)
+			}
+			p.MaxAge = age
+		}
+	}
+	if p.Version != "STSv1" {
+		return nil, fmt.Errorf("unsupported mta-sts policy version %q", p.Version)
+	}
+	switch p.Mode {
+	case STSModeEnforce, STSModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("mta-sts policy has no mx patterns")
+		}
+	case STSModeNone:
+	default:
+		return nil, fmt.Errorf("unsupported mta-sts policy mode %q", p.Mode)
+	}
+	return &p, nil
+}
+
+// Expired indicates if the policy is past its max_age.
+func (p *STSPolicy) Expired(now time.Time) bool {
+	return now.After(p.Fetched.Add(time.Duration(p.MaxAge) * time.Second))
+}
+
+// MatchMX checks if a mail server host is permitted by the policy.
+// A leading wildcard matches exactly one label.
+func (p *STSPolicy) MatchMX(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.TrimSuffix(pattern, ".")
+		if strings.HasPrefix(pattern, "*.") {
+			_, rest, ok := strings.Cut(host, ".")
+			if ok && rest == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// STSFetcher retrieves MTA-STS policies from the network.
+type STSFetcher interface {
+	// PolicyID returns the id of the domain's current policy, from its _mta-sts TXT record.
+	PolicyID(ctx context.Context, domain string) (string, error)
+	// FetchPolicy retrieves the domain's policy.
+	FetchPolicy(ctx context.Context, domain string) (*STSPolicy, error)
+}
+
+// STSCache stores previously fetched MTA-STS policies.
+type STSCache interface {
+	Get(domain string) *STSPolicy
+	Put(domain string, policy *STSPolicy) error
+}
+
+// HTTPSTSFetcher is the default STSFetcher, looking up policies in DNS and
+// retrieving them over HTTPS as described in RFC 8461.
+type HTTPSTSFetcher struct {
+	Client *http.Client
+	// PolicyURL overrides the location a domain's policy is fetched from.
+	PolicyURL func(domain string) string
+	// LookupTXT overrides the resolution of TXT records.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+// PolicyID looks up the policy id in the TXT record at _mta-sts.<domain>.
+func (h *HTTPSTSFetcher) PolicyID(ctx context.Context, domain string) (string, error) {
+	lookup := resolver.LookupTXT
+	if h.LookupTXT != nil {
+		lookup = h.LookupTXT
+	}
+	records, err := lookup(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok && key == "id" {
+				return value, nil
+			}
+		}
+	}
+	return "", errors.New("no mta-sts record")
+}
+
+// FetchPolicy retrieves the policy from https://mta-sts.<domain>/.well-known/mta-sts.txt.
+func (h *HTTPSTSFetcher) FetchPolicy(ctx context.Context, domain string) (*STSPolicy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	if h.PolicyURL != nil {
+		url = h.PolicyURL(domain)
+	}
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	// Redirects must not be followed when fetching a policy.
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching mta-sts policy: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		return nil, fmt.Errorf("unexpected mta-sts policy content type %q", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSTSPolicySize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseSTSPolicy(body)
+}
+
+// FileSTSCache stores MTA-STS policies in a JSON file.
+type FileSTSCache struct {
+	Path string
+}
+
+func (f *FileSTSCache) load() map[string]*STSPolicy {
+	policies := make(map[string]*STSPolicy)
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return policies
+	}
+	json.Unmarshal(b, &policies)
+	return policies
+}
+
+// Get returns the cached policy for a domain, or nil if not present.
+func (f *FileSTSCache) Get(domain string) *STSPolicy {
+	return f.load()[domain]
+}
+
+// Put stores the policy for a domain.
+func (f *FileSTSCache) Put(domain string, policy *STSPolicy) error {
+	policies := f.load()
+	policies[domain] = policy
+	b, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.Path, b, 0600)
+}
+
+// STSPolicies looks up MTA-STS policies, refreshing cached policies when the
+// domain advertises a new policy id or the cached policy expires.
+type STSPolicies struct {
+	Fetcher STSFetcher
+	Cache   STSCache
+}
+
+// Lookup returns the MTA-STS policy in effect for a domain, or nil if it has none.
+func (s *STSPolicies) Lookup(ctx context.Context, domain string) (*STSPolicy, error) {
+	now := time.Now()
+	cached := s.Cache.Get(domain)
+	if cached != nil && cached.Expired(now) {
+		cached = nil
+	}
+
+	id, err := s.Fetcher.PolicyID(ctx, domain)
+	if err != nil {
+		// A domain that stops publishing its record keeps its policy until expiry.
+		return cached, nil
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := s.Fetcher.FetchPolicy(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+	policy.Fetched = now
+	if err := s.Cache.Put(domain, policy); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
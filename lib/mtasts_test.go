@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestSTSPolicies(t *testing.T) {
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n")
+	}))
+	defer srv.Close()
+
+	id := "20240101"
+	policies := STSPolicies{
+		Fetcher: &HTTPSTSFetcher{
+			Client:    srv.Client(),
+			PolicyURL: func(string) string { return srv.URL + "/.well-known/mta-sts.txt" },
+			LookupTXT: func(context.Context, string) ([]string, error) {
+				return []string{"v=STSv1; id=" + id}, nil
+			},
+		},
+		Cache: &FileSTSCache{Path: path.Join(t.TempDir(), "mta-sts.json")},
+	}
+
+	policy, err := policies.Lookup(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Mode != STSModeEnforce || policy.ID != id {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+	if !policy.MatchMX("mail.example.com.") || !policy.MatchMX("mx1.example.net") {
+		t.Fatal("policy should permit listed mx hosts")
+	}
+	if policy.MatchMX("a.b.example.net") || policy.MatchMX("evil.com") {
+		t.Fatal("policy should not permit unlisted mx hosts")
+	}
+
+	// unchanged id is served from cache.
+	if _, err = policies.Lookup(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected cached policy, fetched %d times", fetches)
+	}
+
+	// new id causes a refetch.
+	id = "20240102"
+	if _, err = policies.Lookup(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected policy refresh, fetched %d times", fetches)
+	}
+}
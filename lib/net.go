@@ -2,100 +2,240 @@ package lib
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand"
 	"net"
 	"net/smtp"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/net/proxy"
 )
 
-func getDialer(cfg *Config) proxy.ContextDialer {
+// ErrNullMX is returned when a domain publishes a null MX record (RFC 7505),
+// indicating that it does not accept email.
+var ErrNullMX = errors.New("domain does not accept mail")
+
+// ErrNoStartTLS is returned when a server does not offer StartTLS but the
+// policy for the destination requires it.
+var ErrNoStartTLS = errors.New("server does not offer starttls")
+
+// ErrNoServer is returned when no mail server for a domain could be reached.
+var ErrNoServer = errors.New("unable to connect to any mail server")
+
+var resolver = &net.Resolver{
+	PreferGo: true,
+}
+
+func getDialer(cfg *Config) (proxy.ContextDialer, error) {
 	if cfg.DialerProxy != "" {
 		url, err := url.Parse(cfg.DialerProxy)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		d, err := proxy.FromURL(url, nil)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
 		p, ok := d.(proxy.ContextDialer)
 		if !ok {
-			log.Fatal("Parsed Proxy doesn't support context")
+			return nil, errors.New("parsed proxy doesn't support context")
 		}
-		return p
+		return p, nil
 	}
-	return &net.Dialer{}
+	return &net.Dialer{}, nil
 }
 
-// FindServers resolves the IP addresses of a given destination `domain`
-func FindServers(domain string) []string {
-	resolver := net.Resolver{
-		PreferGo: true,
-	}
-
+// FindServers resolves the mail servers of a given destination `domain`.
+// Servers are returned in order of MX preference, with servers of equal
+// preference shuffled as described in RFC 5321 section 5.1.
+func FindServers(domain string) ([]string, error) {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
 	mxs, err := resolver.LookupMX(ctx, domain)
 	cancel()
 	if err != nil {
-		if dnserr, ok := err.(*net.DNSError); !ok || dnserr.Err != "no such host" {
-			log.Fatal(err)
+		if dnserr, ok := err.(*net.DNSError); !ok || !dnserr.IsNotFound {
+			return nil, err
 		}
 	}
 	if len(mxs) > 0 {
-		hosts := make([]string, len(mxs))
-		for i, mx := range mxs {
-			hosts[i] = mx.Host
-		}
-		return hosts
+		return orderMX(mxs)
 	}
 	// fall back to a record.
-	return []string{domain}
+	return []string{domain}, nil
 }
 
-// DialFromList tries dialing in order a list of IPs as if they are email servers until
-// exhausting possibilities.
-func DialFromList(hosts []string, cfg *Config) (*smtp.Client, string) {
-	dialer := getDialer(cfg)
+// orderMX sorts MX records by preference, shuffling records which share a
+// preference so that load is spread between them.
+func orderMX(mxs []*net.MX) ([]string, error) {
+	if len(mxs) == 1 && mxs[0].Pref == 0 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, ErrNullMX
+	}
 
-	for _, host := range hosts {
-		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
-		conn, err := dialer.DialContext(ctx, "tcp", host+":smtp")
-		cancel()
-		if err == nil {
-			c, err := smtp.NewClient(conn, host)
-			if err == nil {
-				return c, host
-			}
+	shuffled := make([]*net.MX, len(mxs))
+	copy(shuffled, mxs)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	sort.SliceStable(shuffled, func(i, j int) bool {
+		return shuffled[i].Pref < shuffled[j].Pref
+	})
+
+	hosts := make([]string, 0, len(shuffled))
+	for _, mx := range shuffled {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			continue
 		}
+		hosts = append(hosts, host)
 	}
+	if len(hosts) == 0 {
+		return nil, ErrNullMX
+	}
+	return hosts, nil
+}
 
-	// fall back to 587 - mail submission port
+// findAddrs resolves the A / AAAA addresses of a mail server. When a proxy is
+// configured, resolution is left to the proxy and the host is returned as-is.
+func findAddrs(host string, cfg *Config) []string {
+	if cfg.DialerProxy != "" {
+		return []string{host}
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP.String())
+	}
+	return ips
+}
+
+// dialPort tries each address of each host in order on a given port, returning
+// the first successful SMTP client along with the name of the host it belongs to
+// and the address connected to.
+func dialPort(dialer proxy.ContextDialer, hosts []string, port string, cfg *Config) (*smtp.Client, string, string) {
 	for _, host := range hosts {
-		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
-		conn, err := dialer.DialContext(ctx, "tcp", host+":587")
-		cancel()
-		if err == nil {
+		for _, addr := range findAddrs(host, cfg) {
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			cancel()
+			if err != nil {
+				continue
+			}
 			c, err := smtp.NewClient(conn, host)
 			if err == nil {
-				return c, host
+				return c, host, net.JoinHostPort(addr, port)
 			}
+			conn.Close()
 		}
 	}
+	return nil, "", ""
+}
+
+// DialFromList tries dialing in order a list of hosts as if they are email servers until
+// exhausting possibilities. Every address of a host is tried before moving on to the next.
+func DialFromList(hosts []string, cfg *Config) (*smtp.Client, string, error) {
+	c, host, _, err := dialFromList(hosts, cfg)
+	return c, host, err
+}
+
+func dialFromList(hosts []string, cfg *Config) (*smtp.Client, string, string, error) {
+	dialer, err := getDialer(cfg)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if c, host, addr := dialPort(dialer, hosts, "25", cfg); c != nil {
+		return c, host, addr, nil
+	}
 
-	log.Fatal("Unable to connect to any mail server")
-	return nil, ""
+	// fall back to 587 - mail submission port
+	if c, host, addr := dialPort(dialer, hosts, "587", cfg); c != nil {
+		return c, host, addr, nil
+	}
+
+	return nil, "", "", ErrNoServer
+}
+
+// redial opens a new connection to a specific address of a mail server.
+func redial(addr, host string, cfg *Config) (*smtp.Client, error) {
+	dialer, err := getDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Second))
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
 // StartTLS attempts to upgrade an SMTP network connection with StartTLS.
 func StartTLS(conn *smtp.Client, serverName string, cfg *Config, allowSelfSigned bool) error {
-	tlsCfg := cfg.GetTLS()
+	_, err := startTLS(conn, serverName, cfg, 0, webPKIVerifier(serverName), !allowSelfSigned)
+	return err
+}
+
+// startTLS upgrades a connection, checking the server's certificates with
+// `check`. When `enforce` is set a failed check aborts the handshake,
+// otherwise the failure is returned for the caller to record.
+func startTLS(conn *smtp.Client, serverName string, cfg *Config, minVersion uint16, check func(tls.ConnectionState) error, enforce bool) (verifyErr error, err error) {
+	baseCfg, err := cfg.GetTLS()
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := baseCfg.Clone()
 	tlsCfg.ServerName = serverName
-	if allowSelfSigned {
-		tlsCfg.InsecureSkipVerify = true
+	tlsCfg.InsecureSkipVerify = true
+	if minVersion != 0 {
+		tlsCfg.MinVersion = minVersion
+	}
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		verifyErr = check(cs)
+		if enforce {
+			return verifyErr
+		}
+		return nil
+	}
+	err = conn.StartTLS(tlsCfg)
+	return verifyErr, err
+}
+
+func webPKIVerifier(serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		return verifyPeer(cs, serverName, nil)
+	}
+}
+
+// verifyPeer performs WebPKI validation of the certificates presented by a server.
+func verifyPeer(cs tls.ConnectionState, serverName string, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
 	}
-	return conn.StartTLS(tlsCfg)
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
 }
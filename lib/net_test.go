@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOrderMX(t *testing.T) {
+	mxs := []*net.MX{
+		{Host: "backup.example.com.", Pref: 20},
+		{Host: "a.example.com.", Pref: 10},
+		{Host: "b.example.com.", Pref: 10},
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		hosts, err := orderMX(mxs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hosts) != 3 || hosts[2] != "backup.example.com" {
+			t.Fatalf("hosts not sorted by preference: %v", hosts)
+		}
+		seen[hosts[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Fatal("equal preference hosts were not shuffled")
+	}
+
+	if _, err := orderMX([]*net.MX{{Host: ".", Pref: 0}}); err != ErrNullMX {
+		t.Fatalf("expected null mx error, got %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// SendOptions controls how a message is delivered to a destination domain.
+type SendOptions struct {
+	// TLS is the policy for the use of StartTLS with the destination.
+	TLS TLSPolicy
+	// STS is the MTA-STS policy of the destination domain, if it has one.
+	STS *STSPolicy
+	// DANE, if set, is used to look up TLSA records for the mail server. When
+	// records exist, StartTLS is required and the server's certificate is
+	// verified against them rather than with WebPKI. Records are ignored when
+	// the MX lookup of the destination was not DNSSEC validated. It is
+	// required by TLSModeDANE policies.
+	DANE TLSAResolver
+}
+
+// DeliveryResult records the outcome of delivery to a single destination domain.
+type DeliveryResult struct {
+	Domain string
+	Host   string
+	// Addr is the network address of the server connected to.
+	Addr string
+	// Encrypted indicates the message was sent over a connection upgraded with
+	// StartTLS, using TLSVersion and TLSCipher.
+	Encrypted  bool
+	TLSVersion string
+	TLSCipher  string
+	// TLS is the state of the connection if it was upgraded with StartTLS.
+	TLS *tls.ConnectionState
+	// TLSVerifyError is set if the server's certificate did not validate.
+	TLSVerifyError error
+	// DANE indicates the server's certificate was checked against TLSA records.
+	DANE bool
+	// TLSA holds the DNSSEC validated TLSA records of the server, if any.
+	TLSA []TLSA
+	// Violations lists TLS problems which did not prevent delivery, such as
+	// departures from an MTA-STS policy in testing mode.
+	Violations []string
+	// Accepted holds the recipients accepted by the server. The message was
+	// delivered to them if SendTo did not return an error.
+	Accepted []string
+	// Failed holds the recipients refused by the server, with the reason for each.
+	Failed map[string]*DeliveryError
+}
+
+// SendTo delivers a message to the recipients at a single destination domain.
+// Recipients refused by the server are recorded individually in the result, and
+// the message is delivered to those remaining. Failures affecting the whole
+// domain are reported as a *DeliveryError.
+func SendTo(dest string, parsed *ParsedMessage, cfg *Config, opts SendOptions) (*DeliveryResult, error) {
+	result := &DeliveryResult{
+		Domain: dest,
+		Failed: make(map[string]*DeliveryError),
+	}
+
+	enforce := opts.STS != nil && opts.STS.Mode == STSModeEnforce
+	testing := opts.STS != nil && opts.STS.Mode == STSModeTesting
+
+	// enumerate possible mx hosts
+	hosts, err := FindServers(dest)
+	if err != nil {
+		return result, NewDeliveryError(dest, "", StageConnect, err)
+	}
+	if enforce || testing {
+		permitted := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			if opts.STS.MatchMX(host) {
+				permitted = append(permitted, host)
+			} else if testing {
+				result.Violations = append(result.Violations, fmt.Sprintf("mx %s not permitted by policy", host))
+			}
+		}
+		if enforce {
+			if len(permitted) == 0 {
+				return result, NewDeliveryError(dest, "", StageConnect, ErrSTSNoMX)
+			}
+			hosts = permitted
+		}
+	}
+
+	// DANE only applies to servers found through a DNSSEC validated MX lookup.
+	secureMX := false
+	if opts.DANE != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		secureMX, err = opts.DANE.SecureMX(ctx, dest)
+		cancel()
+		if err != nil {
+			return result, NewDeliveryError(dest, "", StageConnect, err)
+		}
+	}
+
+	// open connection
+	conn, hostname, addr, err := dialFromList(hosts, cfg)
+	if err != nil {
+		return result, NewDeliveryError(dest, "", StageConnect, err)
+	}
+	defer func() { conn.Close() }()
+	result.Host = hostname
+	result.Addr = addr
+
+	helloSrc := parsed.SourceDomain
+	if len(cfg.SourceHost) > 0 {
+		helloSrc = cfg.SourceHost
+	}
+	if err := conn.Hello(helloSrc); err != nil {
+		return result, NewDeliveryError(dest, hostname, StageHello, err)
+	}
+
+	// try ssl upgrade
+	if plaintextOK, err := negotiateTLS(conn, hostname, addr, cfg, opts, secureMX, result); err != nil {
+		if !plaintextOK {
+			return result, NewDeliveryError(dest, hostname, StageStartTLS, err)
+		}
+		// A failed handshake leaves the connection unusable, so when the
+		// policy allows plaintext delivery the server is dialed again.
+		result.Violations = append(result.Violations, fmt.Sprintf("starttls with %s failed: %v", hostname, err))
+		conn.Close()
+		if conn, err = redial(addr, hostname, cfg); err != nil {
+			return result, NewDeliveryError(dest, hostname, StageConnect, err)
+		}
+		if err := conn.Hello(helloSrc); err != nil {
+			return result, NewDeliveryError(dest, hostname, StageHello, err)
+		}
+	}
+
+	// send email
+	if err := conn.Mail(parsed.Sender); err != nil {
+		return result, NewDeliveryError(dest, hostname, StageMail, err)
+	}
+
+	accepted := make([]string, 0, len(parsed.Rcpt[dest]))
+	for _, rcpt := range parsed.Rcpt[dest] {
+		if err := conn.Rcpt(rcpt); err != nil {
+			var tpErr *textproto.Error
+			if !errors.As(err, &tpErr) {
+				// the connection itself failed rather than the server refusing this recipient.
+				return result, NewDeliveryError(dest, hostname, StageRcpt, err)
+			}
+			result.Failed[rcpt] = NewDeliveryError(dest, hostname, StageRcpt, err)
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	result.Accepted = accepted
+	if len(accepted) == 0 {
+		conn.Quit()
+		return result, nil
+	}
+
+	// Send the email body.
+	wc, err := conn.Data()
+	if err != nil {
+		return result, NewDeliveryError(dest, hostname, StageData, err)
+	}
+	if _, err := io.Copy(wc, bytes.NewReader(*parsed.Bytes)); err != nil {
+		wc.Close()
+		return result, NewDeliveryError(dest, hostname, StageData, err)
+	}
+	if err := wc.Close(); err != nil {
+		return result, NewDeliveryError(dest, hostname, StageData, err)
+	}
+
+	// Send the QUIT command and close the connection.
+	conn.Quit()
+	return result, nil
+}
+
+// negotiateTLS upgrades the connection to a server as required by the TLS
+// policy, MTA-STS policy, and DANE records of the destination, recording the
+// outcome in the result. StartTLS is used whenever the server offers it. If
+// the upgrade fails, `plaintextOK` indicates if the policies in effect allow
+// delivery to continue without encryption. TLSA records are only consulted
+// when `secureMX` indicates the server was found through a DNSSEC validated
+// MX lookup.
+func negotiateTLS(conn *smtp.Client, hostname, addr string, cfg *Config, opts SendOptions, secureMX bool, result *DeliveryResult) (plaintextOK bool, err error) {
+	policy := opts.TLS
+	enforceSTS := opts.STS != nil && opts.STS.Mode == STSModeEnforce
+	testing := opts.STS != nil && opts.STS.Mode == STSModeTesting
+
+	// look up DANE TLSA records for the server.
+	usable := make([]TLSA, 0)
+	daneRecords := false
+	if opts.DANE == nil {
+		if policy.Mode == TLSModeDANE {
+			return false, errors.New("dane policy without a tlsa resolver")
+		}
+	} else if !secureMX {
+		if policy.Mode == TLSModeDANE {
+			return false, fmt.Errorf("mx lookup for %s: %w", hostname, ErrInsecureDNS)
+		}
+	} else {
+		_, port, _ := net.SplitHostPort(addr)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		records, err := opts.DANE.LookupTLSA(ctx, "_"+port+"._tcp."+hostname)
+		cancel()
+		if err != nil && !errors.Is(err, ErrInsecureDNS) {
+			return false, err
+		}
+		daneRecords = len(records) > 0
+		result.TLSA = records
+		for _, rec := range records {
+			if rec.Usable() {
+				usable = append(usable, rec)
+			}
+		}
+	}
+	if policy.Mode == TLSModeDANE && len(usable) == 0 {
+		return false, fmt.Errorf("no usable tlsa records for %s", hostname)
+	}
+
+	// A policy of none is only honored when neither an enforced MTA-STS policy
+	// nor TLSA records require the connection to be encrypted.
+	if policy.Mode == TLSModeNone && !enforceSTS && !daneRecords {
+		if testing {
+			result.Violations = append(result.Violations, fmt.Sprintf("starttls not used with %s", hostname))
+		}
+		return false, nil
+	}
+
+	// DANE takes precedence over MTA-STS. If TLSA records exist but none are
+	// usable, the connection must still be encrypted but is not authenticated.
+	check := webPKIVerifier(hostname)
+	verify := false
+	switch {
+	case len(usable) > 0:
+		check = func(cs tls.ConnectionState) error {
+			return VerifyDANE(cs, hostname, usable)
+		}
+		verify = true
+		result.DANE = true
+	case policy.Mode == TLSModeFingerprint:
+		check = policy.matchFingerprint
+		verify = true
+	case daneRecords:
+	case policy.Mode == TLSModeVerify || enforceSTS:
+		verify = true
+	}
+	required := policy.RequiresTLS() || enforceSTS || daneRecords
+
+	if ok, _ := conn.Extension("STARTTLS"); !ok {
+		if required {
+			return false, fmt.Errorf("%s: %w", hostname, ErrNoStartTLS)
+		}
+		if testing {
+			result.Violations = append(result.Violations, fmt.Sprintf("starttls not offered by %s", hostname))
+		}
+		return false, nil
+	}
+
+	verifyErr, err := startTLS(conn, hostname, cfg, policy.MinVersion, check, verify)
+	result.TLSVerifyError = verifyErr
+	if err != nil {
+		return !required, err
+	}
+	if state, ok := conn.TLSConnectionState(); ok {
+		result.TLS = &state
+		result.Encrypted = true
+		result.TLSVersion = tls.VersionName(state.Version)
+		result.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	if testing && verifyErr != nil {
+		result.Violations = append(result.Violations, fmt.Sprintf("certificate of %s invalid: %v", hostname, verifyErr))
+	}
+	return false, nil
+}
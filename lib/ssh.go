@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// IsSSHCommand indicates if a SendCommand is of the form
+// "ssh://user@host[:port]/path/to/sendmail", to be run with an SSHTransport.
+func IsSSHCommand(cmd string) bool {
+	return strings.HasPrefix(cmd, "ssh://")
+}
+
+// SSHTransport runs send commands on remote hosts over in-process SSH
+// connections. Connections are kept open and reused for later messages to
+// the same host until the transport is closed.
+type SSHTransport struct {
+	// HostKeyCallback overrides verification of host keys against known_hosts.
+	HostKeyCallback ssh.HostKeyCallback
+	// Auth overrides authentication with the ssh agent and key files.
+	Auth []ssh.AuthMethod
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+	// agent is the connection to the ssh agent, shared by all dials.
+	agent net.Conn
+}
+
+func homeFile(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".ssh", name)
+}
+
+// authMethods lists the ways to authenticate to a host. It is called with
+// t.mu held.
+func (t *SSHTransport) authMethods(cfg *Config) []ssh.AuthMethod {
+	if t.Auth != nil {
+		return t.Auth
+	}
+	methods := make([]ssh.AuthMethod, 0, 2)
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && t.agent == nil {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			t.agent = conn
+		}
+	}
+	if t.agent != nil {
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(t.agent).Signers))
+	}
+
+	keyFiles := []string{cfg.SSHKey}
+	if cfg.SSHKey == "" {
+		keyFiles = []string{homeFile("id_ed25519"), homeFile("id_ecdsa"), homeFile("id_rsa")}
+	}
+	signers := make([]ssh.Signer, 0, len(keyFiles))
+	for _, file := range keyFiles {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(pem); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+func (t *SSHTransport) hostKeyCallback(cfg *Config) (ssh.HostKeyCallback, error) {
+	if t.HostKeyCallback != nil {
+		return t.HostKeyCallback, nil
+	}
+	file := cfg.SSHKnownHosts
+	if file == "" {
+		file = homeFile("known_hosts")
+	}
+	return knownhosts.New(file)
+}
+
+// client returns an open connection to the host of a send command, dialing
+// a new one if needed.
+func (t *SSHTransport) client(u *url.URL, cfg *Config) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients == nil {
+		t.clients = make(map[string]*ssh.Client)
+	}
+	if c, ok := t.clients[u.User.String()+"@"+u.Host]; ok {
+		return c, nil
+	}
+
+	hostKeyCallback, err := t.hostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	c, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            t.authMethods(cfg),
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.clients[u.User.String()+"@"+u.Host] = c
+	return c, nil
+}
+
+func (t *SSHTransport) drop(u *url.URL) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := u.User.String() + "@" + u.Host
+	if c, ok := t.clients[key]; ok {
+		c.Close()
+		delete(t.clients, key)
+	}
+}
+
+// Run executes the remote send command configured for a domain, passing
+// `env` ("KEY=value" pairs) to the remote process and streaming stdin to it.
+func (t *SSHTransport) Run(cfg *Config, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	u, err := url.Parse(cfg.SendCommand)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ssh" || u.Host == "" || u.Path == "" {
+		return fmt.Errorf("invalid ssh send command %q", cfg.SendCommand)
+	}
+	command := u.Path
+	if strings.HasPrefix(command, "/~/") {
+		command = command[1:]
+	}
+
+	c, err := t.client(u, cfg)
+	if err != nil {
+		return err
+	}
+	session, err := c.NewSession()
+	if err != nil {
+		// the cached connection may have been closed by the server.
+		t.drop(u)
+		if c, err = t.client(u, cfg); err != nil {
+			return err
+		}
+		if session, err = c.NewSession(); err != nil {
+			return err
+		}
+	}
+	defer session.Close()
+
+	// Servers only accept environment variables permitted by their AcceptEnv
+	// configuration. Those which are refused are set in the command instead.
+	inline := make([]string, 0)
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if err := session.Setenv(k, v); err != nil {
+			inline = append(inline, k+"="+shellQuote(v))
+		}
+	}
+	if len(inline) > 0 {
+		command = strings.Join(inline, " ") + " " + command
+	}
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return session.Run(command)
+}
+
+// Close closes all open connections, including that to the ssh agent.
+func (t *SSHTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for key, c := range t.clients {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(t.clients, key)
+	}
+	if t.agent != nil {
+		if err := t.agent.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		t.agent = nil
+	}
+	return errors.Join(errs...)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
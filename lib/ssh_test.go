@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveSSH accepts ssh connections which echo stdin back along with the
+// environment and command of each session.
+func serveSSH(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey, conns *int32) net.Listener {
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), userKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					ch, reqs, _ := nch.Accept()
+					go func() {
+						env := ""
+						for req := range reqs {
+							switch req.Type {
+							case "env":
+								var kv struct{ K, V string }
+								ssh.Unmarshal(req.Payload, &kv)
+								env += kv.K + "=" + kv.V + "\n"
+								req.Reply(true, nil)
+							case "exec":
+								var cmd struct{ C string }
+								ssh.Unmarshal(req.Payload, &cmd)
+								req.Reply(true, nil)
+								body, _ := io.ReadAll(ch)
+								io.WriteString(ch, env+cmd.C+"\n"+string(body))
+								status := make([]byte, 4)
+								binary.BigEndian.PutUint32(status, 0)
+								ch.SendRequest("exit-status", false, status)
+								ch.Close()
+							default:
+								req.Reply(false, nil)
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSSHTransport(t *testing.T) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(hostPriv)
+	_, userPriv, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := ssh.NewSignerFromKey(userPriv)
+
+	var conns int32
+	l := serveSSH(t, hostKey, userKey.PublicKey(), &conns)
+	defer l.Close()
+
+	transport := &SSHTransport{
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+	}
+	defer transport.Close()
+	cfg := &Config{SendCommand: "ssh://mail@" + l.Addr().String() + "/usr/local/bin/sendmail"}
+
+	for i := 0; i < 2; i++ {
+		var stdout, stderr bytes.Buffer
+		err := transport.Run(cfg, []string{"GOSENDMAIL_RECIPIENTS=a@example.com"},
+			strings.NewReader("message body"), &stdout, &stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "GOSENDMAIL_RECIPIENTS=a@example.com\n/usr/local/bin/sendmail\nmessage body"
+		if stdout.String() != expected {
+			t.Fatalf("unexpected session output: %q", stdout.String())
+		}
+	}
+	if atomic.LoadInt32(&conns) != 1 {
+		t.Fatalf("expected connection reuse, got %d connections", conns)
+	}
+
+	wrongHost := &SSHTransport{
+		HostKeyCallback: ssh.FixedHostKey(userKey.PublicKey()),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+	}
+	if err := wrongHost.Run(cfg, nil, strings.NewReader(""), io.Discard, io.Discard); err == nil {
+		t.Fatal("expected host key mismatch to fail")
+	}
+}
+
+func TestSSHTransportAgent(t *testing.T) {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(hostPriv)
+	_, userPriv, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := ssh.NewSignerFromKey(userPriv)
+
+	var conns int32
+	l := serveSSH(t, hostKey, userKey.PublicKey(), &conns)
+	defer l.Close()
+
+	// unix socket paths are limited in length, so avoid t.TempDir.
+	dir, err := os.MkdirTemp("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: userPriv}); err != nil {
+		t.Fatal(err)
+	}
+	sock, err := net.Listen("unix", path.Join(dir, "agent.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	var agentConns int32
+	served := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&agentConns, 1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				served <- struct{}{}
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock.Addr().String())
+
+	transport := &SSHTransport{HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey())}
+	for _, user := range []string{"mail", "other"} {
+		cfg := &Config{SendCommand: "ssh://" + user + "@" + l.Addr().String() + "/usr/local/bin/sendmail", SSHKey: "/nonexistent"}
+		if err := transport.Run(cfg, nil, strings.NewReader(""), io.Discard, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&agentConns); n != 1 {
+		t.Fatalf("expected the agent connection to be shared, got %d connections", n)
+	}
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent connection not closed")
+	}
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// TLS policy modes for delivery to a destination domain.
+const (
+	// TLSModeNone does not use StartTLS, unless an enforced MTA-STS policy or
+	// DANE TLSA records of the destination require it.
+	TLSModeNone = "none"
+	// TLSModeMay uses StartTLS when the server offers it, without verification.
+	TLSModeMay = "may"
+	// TLSModeEncrypt requires StartTLS, without verification.
+	TLSModeEncrypt = "encrypt"
+	// TLSModeVerify requires StartTLS with a WebPKI-valid certificate.
+	TLSModeVerify = "verify"
+	// TLSModeDANE requires StartTLS with a certificate matching DANE TLSA records.
+	TLSModeDANE = "dane"
+	// TLSModeFingerprint requires StartTLS with a certificate matching a pinned fingerprint.
+	TLSModeFingerprint = "fingerprint"
+)
+
+// TLSPolicy describes the TLS requirements for delivery to a destination domain.
+type TLSPolicy struct {
+	Mode string
+	// MinVersion is the minimum TLS version to negotiate, e.g. tls.VersionTLS12.
+	MinVersion uint16
+	// Fingerprints are hex encoded SHA-256 digests of acceptable server
+	// certificates, used with TLSModeFingerprint.
+	Fingerprints []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// RequiresTLS indicates if delivery must fail when StartTLS can't be used.
+func (t *TLSPolicy) RequiresTLS() bool {
+	return t.Mode != TLSModeNone && t.Mode != TLSModeMay
+}
+
+// matchFingerprint checks the server's certificate against pinned fingerprints.
+func (t *TLSPolicy) matchFingerprint(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	actual := hex.EncodeToString(sum[:])
+	for _, fp := range t.Fingerprints {
+		if strings.EqualFold(strings.ReplaceAll(fp, ":", ""), actual) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate fingerprint %s is not pinned", actual)
+}
+
+// ParseTLSPolicy reads a policy from its configuration representation.
+func ParseTLSPolicy(cfgMap map[string]interface{}) (*TLSPolicy, error) {
+	p := TLSPolicy{Mode: TLSModeMay}
+	if mode, ok := cfgMap["mode"].(string); ok {
+		p.Mode = strings.ToLower(mode)
+	}
+	switch p.Mode {
+	case TLSModeNone, TLSModeMay, TLSModeEncrypt, TLSModeVerify, TLSModeDANE, TLSModeFingerprint:
+	default:
+		return nil, fmt.Errorf("unknown tls policy mode %q", p.Mode)
+	}
+	if version, ok := cfgMap["minversion"].(string); ok {
+		v, ok := tlsVersions[version]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", version)
+		}
+		p.MinVersion = v
+	}
+	switch fps := cfgMap["fingerprints"].(type) {
+	case string:
+		p.Fingerprints = []string{fps}
+	case []interface{}:
+		for _, fp := range fps {
+			if s, ok := fp.(string); ok {
+				p.Fingerprints = append(p.Fingerprints, s)
+			}
+		}
+	}
+	if p.Mode == TLSModeFingerprint && len(p.Fingerprints) == 0 {
+		return nil, errors.New("fingerprint tls policy has no fingerprints")
+	}
+	return &p, nil
+}
+
+// GetTLSPolicy looks up the policy for a destination domain in the "TLSPolicy"
+// section of the currently loaded configuration. An exact match for the domain
+// is preferred, then wildcards ("*.example.com") of successively shorter parent
+// domains, and finally the "*" entry. nil is returned if no entry applies.
+func GetTLSPolicy(domain string) (*TLSPolicy, error) {
+	table, ok := viper.Get("tlspolicy").(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	candidates := []string{domain}
+	for parent := domain; ; {
+		_, rest, ok := strings.Cut(parent, ".")
+		if !ok {
+			break
+		}
+		candidates = append(candidates, "*."+rest)
+		parent = rest
+	}
+	candidates = append(candidates, "*")
+
+	for _, key := range candidates {
+		if entry, ok := table[key].(map[string]interface{}); ok {
+			return ParseTLSPolicy(entry)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetTLSPolicy(t *testing.T) {
+	viper.SetConfigType("json")
+	err := viper.ReadConfig(strings.NewReader(`{
+		"TLSPolicy": {
+			"partner.com": {"Mode": "verify", "MinVersion": "1.2"},
+			"*.example.org": {"Mode": "fingerprint", "Fingerprints": ["AB:CD"]},
+			"*": {"Mode": "may"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viper.Reset()
+
+	p, err := GetTLSPolicy("partner.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != TLSModeVerify || p.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected policy for exact match: %+v", p)
+	}
+
+	p, err = GetTLSPolicy("mail.eu.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != TLSModeFingerprint || len(p.Fingerprints) != 1 {
+		t.Fatalf("unexpected policy for wildcard match: %+v", p)
+	}
+
+	p, err = GetTLSPolicy("gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != TLSModeMay || p.RequiresTLS() {
+		t.Fatalf("unexpected default policy: %+v", p)
+	}
+}
@@ -0,0 +1,398 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLS policy types and failure result types from RFC 8460 section 4.
+const (
+	TLSRPTPolicySTS      = "sts"
+	TLSRPTPolicyTLSA     = "tlsa"
+	TLSRPTPolicyNotFound = "no-policy-found"
+
+	TLSRPTStartTLSNotSupported    = "starttls-not-supported"
+	TLSRPTCertificateHostMismatch = "certificate-host-mismatch"
+	TLSRPTCertificateExpired      = "certificate-expired"
+	TLSRPTCertificateNotTrusted   = "certificate-not-trusted"
+	TLSRPTValidationFailure       = "validation-failure"
+	TLSRPTSTSPolicyFetchError     = "sts-policy-fetch-error"
+	TLSRPTSTSWebPKIInvalid        = "sts-webpki-invalid"
+)
+
+// TLSSession records the outcome of a TLS negotiation with a destination
+// mail server, for inclusion in TLS reports.
+type TLSSession struct {
+	Time         time.Time `json:"time"`
+	PolicyDomain string    `json:"policy-domain"`
+	PolicyType   string    `json:"policy-type"`
+	PolicyString []string  `json:"policy-string,omitempty"`
+	MXHost       []string  `json:"mx-host,omitempty"`
+	ReceivingMX  string    `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP  string    `json:"receiving-ip,omitempty"`
+	// ResultType is empty for successful sessions.
+	ResultType    string `json:"result-type,omitempty"`
+	FailureReason string `json:"failure-reason,omitempty"`
+}
+
+// NewTLSSession describes the TLS outcome of a call to `SendTo`. `stsErr`
+// should be set if the MTA-STS policy of the destination could not be fetched.
+// Deliveries which ended without a TLS session or a policy failure, such as
+// when no server could be reached or StartTLS was not used, have nothing to
+// report and return false.
+func NewTLSSession(opts SendOptions, result *DeliveryResult, err error, stsErr error) (TLSSession, bool) {
+	session := TLSSession{
+		Time:         time.Now().UTC(),
+		PolicyDomain: result.Domain,
+		PolicyType:   TLSRPTPolicyNotFound,
+		ReceivingMX:  result.Host,
+	}
+	if host, _, splitErr := net.SplitHostPort(result.Addr); splitErr == nil {
+		session.ReceivingIP = host
+	}
+
+	switch {
+	case len(result.TLSA) > 0:
+		session.PolicyType = TLSRPTPolicyTLSA
+		for _, rec := range result.TLSA {
+			session.PolicyString = append(session.PolicyString,
+				fmt.Sprintf("%d %d %d %s", rec.Usage, rec.Selector, rec.MatchingType, hex.EncodeToString(rec.Data)))
+		}
+	case opts.STS != nil && opts.STS.Mode != STSModeNone:
+		session.PolicyType = TLSRPTPolicySTS
+		session.PolicyString = []string{"version: " + opts.STS.Version, "mode: " + opts.STS.Mode}
+		for _, mx := range opts.STS.MX {
+			session.PolicyString = append(session.PolicyString, "mx: "+mx)
+		}
+		session.PolicyString = append(session.PolicyString, "max_age: "+strconv.Itoa(opts.STS.MaxAge))
+		session.MXHost = opts.STS.MX
+	}
+
+	var de *DeliveryError
+	errors.As(err, &de)
+	switch {
+	case stsErr != nil && session.PolicyType == TLSRPTPolicyNotFound:
+		session.ResultType = TLSRPTSTSPolicyFetchError
+		session.FailureReason = stsErr.Error()
+	case errors.Is(err, ErrNoStartTLS):
+		session.ResultType = TLSRPTStartTLSNotSupported
+	case errors.Is(err, ErrSTSNoMX):
+		session.ResultType = TLSRPTValidationFailure
+		session.FailureReason = err.Error()
+	case result.TLSVerifyError != nil && (result.DANE || session.PolicyType == TLSRPTPolicySTS):
+		session.ResultType = classifyCertError(result.TLSVerifyError, session.PolicyType)
+		session.FailureReason = result.TLSVerifyError.Error()
+	case de != nil && de.Stage == StageStartTLS:
+		session.ResultType = TLSRPTValidationFailure
+		session.FailureReason = de.Err.Error()
+	case !result.Encrypted && session.PolicyType != TLSRPTPolicyNotFound && result.Host != "":
+		session.ResultType = TLSRPTStartTLSNotSupported
+	}
+	if session.ResultType == "" && !result.Encrypted {
+		return session, false
+	}
+	return session, true
+}
+
+func classifyCertError(err error, policyType string) string {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authErr x509.UnknownAuthorityError
+	switch {
+	case errors.As(err, &hostErr):
+		return TLSRPTCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return TLSRPTCertificateExpired
+	case errors.As(err, &authErr):
+		return TLSRPTCertificateNotTrusted
+	case policyType == TLSRPTPolicySTS:
+		return TLSRPTSTSWebPKIInvalid
+	default:
+		return TLSRPTValidationFailure
+	}
+}
+
+// TLSSessionStore accumulates TLS session outcomes as newline-delimited JSON.
+// Access is coordinated between processes with an advisory lock on a file
+// alongside the store: appends share the lock, while pruning holds it
+// exclusively.
+type TLSSessionStore struct {
+	Path string
+}
+
+// lock waits for the store lock, returning a function releasing it.
+func (s *TLSSessionStore) lock(exclusive bool) (func(), error) {
+	f, err := os.OpenFile(s.Path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Append records a session.
+func (s *TLSSessionStore) Append(session TLSSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Load returns the sessions recorded in the interval [start, end).
+func (s *TLSSessionStore) Load(start, end time.Time) ([]TLSSession, error) {
+	return s.load(func(t time.Time) bool {
+		return !t.Before(start) && t.Before(end)
+	})
+}
+
+// load returns the recorded sessions whose time satisfies `keep`.
+func (s *TLSSessionStore) load(keep func(time.Time) bool) ([]TLSSession, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sessions := make([]TLSSession, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		session := TLSSession{}
+		if err := json.Unmarshal(scanner.Bytes(), &session); err != nil {
+			continue
+		}
+		if keep(session.Time) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, scanner.Err()
+}
+
+// Prune removes sessions recorded before a given time.
+func (s *TLSSessionStore) Prune(before time.Time) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	kept, err := s.load(func(t time.Time) bool {
+		return !t.Before(before)
+	})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, session := range kept {
+		b, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	return WriteFileAtomic(s.Path, buf.Bytes())
+}
+
+// TLSReport is an RFC 8460 aggregate report.
+type TLSReport struct {
+	OrganizationName string             `json:"organization-name"`
+	DateRange        TLSReportRange     `json:"date-range"`
+	ContactInfo      string             `json:"contact-info"`
+	ReportID         string             `json:"report-id"`
+	Policies         []*TLSReportPolicy `json:"policies"`
+}
+
+// TLSReportRange is the interval covered by a report.
+type TLSReportRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// TLSReportPolicy summarizes the sessions made under a single policy.
+type TLSReportPolicy struct {
+	Policy struct {
+		PolicyType   string   `json:"policy-type"`
+		PolicyString []string `json:"policy-string,omitempty"`
+		PolicyDomain string   `json:"policy-domain"`
+		MXHost       []string `json:"mx-host,omitempty"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int `json:"total-successful-session-count"`
+		Failure    int `json:"total-failure-session-count"`
+	} `json:"summary"`
+	FailureDetails []*TLSReportFailure `json:"failure-details,omitempty"`
+}
+
+// TLSReportFailure counts failed sessions with a common cause.
+type TLSReportFailure struct {
+	ResultType          string `json:"result-type"`
+	ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int    `json:"failed-session-count"`
+	FailureReasonCode   string `json:"failure-reason-code,omitempty"`
+}
+
+// BuildTLSReports aggregates sessions into a report for each policy domain.
+func BuildTLSReports(org, contact string, start, end time.Time, sessions []TLSSession) map[string]*TLSReport {
+	reports := make(map[string]*TLSReport)
+	policies := make(map[string]*TLSReportPolicy)
+	failures := make(map[string]*TLSReportFailure)
+
+	for _, session := range sessions {
+		report, ok := reports[session.PolicyDomain]
+		if !ok {
+			report = &TLSReport{
+				OrganizationName: org,
+				DateRange:        TLSReportRange{Start: start.UTC(), End: end.UTC()},
+				ContactInfo:      contact,
+				ReportID:         start.UTC().Format("2006-01-02") + "_" + session.PolicyDomain + "_" + randomID(),
+			}
+			reports[session.PolicyDomain] = report
+		}
+
+		policyKey := session.PolicyDomain + "\x00" + session.PolicyType + "\x00" + strings.Join(session.PolicyString, "\x00")
+		policy, ok := policies[policyKey]
+		if !ok {
+			policy = &TLSReportPolicy{}
+			report.Policies = append(report.Policies, policy)
+			policy.Policy.PolicyType = session.PolicyType
+			policy.Policy.PolicyString = session.PolicyString
+			policy.Policy.PolicyDomain = session.PolicyDomain
+			policy.Policy.MXHost = session.MXHost
+			policies[policyKey] = policy
+		}
+
+		if session.ResultType == "" {
+			policy.Summary.Successful++
+			continue
+		}
+		policy.Summary.Failure++
+		failureKey := policyKey + "\x00" + session.ResultType + "\x00" + session.ReceivingMX + "\x00" + session.ReceivingIP
+		failure, ok := failures[failureKey]
+		if !ok {
+			failure = &TLSReportFailure{
+				ResultType:          session.ResultType,
+				ReceivingMXHostname: session.ReceivingMX,
+				ReceivingIP:         session.ReceivingIP,
+				FailureReasonCode:   session.FailureReason,
+			}
+			policy.FailureDetails = append(policy.FailureDetails, failure)
+			failures[failureKey] = failure
+		}
+		failure.FailedSessionCount++
+	}
+	return reports
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LookupTLSRPT returns the mailto: report addresses published in the
+// _smtp._tls TXT record of a domain.
+func LookupTLSRPT(ctx context.Context, domain string) ([]string, error) {
+	records, err := resolver.LookupTXT(ctx, "_smtp._tls."+domain)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTLSRPTRecord(records), nil
+}
+
+// ParseTLSRPTRecord extracts mailto: report addresses from TLSRPT TXT records.
+func ParseTLSRPTRecord(records []string) []string {
+	addrs := make([]string, 0)
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=TLSRPTv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if !ok || key != "rua" {
+				continue
+			}
+			for _, uri := range strings.Split(value, ",") {
+				uri = strings.TrimSpace(uri)
+				if strings.HasPrefix(uri, "mailto:") {
+					addrs = append(addrs, strings.TrimPrefix(uri, "mailto:"))
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// TLSReportMessage renders a report as an email message, per RFC 8460 section 5.3.
+func TLSReportMessage(report *TLSReport, domain, from string, to []string) ([]byte, error) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	filename := fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", report.OrganizationName, domain,
+		report.DateRange.Start.Unix(), report.DateRange.End.Unix(), randomID())
+	boundary := "tlsrpt-" + randomID()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, report.OrganizationName, report.ReportID)
+	fmt.Fprintf(&msg, "TLS-Report-Domain: %s\r\n", domain)
+	fmt.Fprintf(&msg, "TLS-Report-Submitter: %s\r\n", report.OrganizationName)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=\"%s\"\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: text/plain; charset=\"us-ascii\"\r\n\r\n", boundary)
+	fmt.Fprintf(&msg, "This is an aggregate TLS report from %s for %s.\r\n\r\n", report.OrganizationName, domain)
+	fmt.Fprintf(&msg, "--%s\r\nContent-Type: application/tlsrpt+gzip\r\n", boundary)
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&msg, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
+	encoded := base64.StdEncoding.EncodeToString(gz.Bytes())
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	return msg.Bytes(), nil
+}
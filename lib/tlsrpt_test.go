@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTLSReports(t *testing.T) {
+	store := &TLSSessionStore{Path: path.Join(t.TempDir(), "tlsrpt.jsonl")}
+	start := time.Now().UTC().Truncate(24 * time.Hour)
+	end := start.Add(24 * time.Hour)
+
+	sts := &STSPolicy{Version: "STSv1", Mode: STSModeEnforce, MX: []string{"mx.example.com"}, MaxAge: 86400}
+	ok := &DeliveryResult{Domain: "example.com", Host: "mx.example.com", Addr: "192.0.2.1:25", Encrypted: true}
+	failed := &DeliveryResult{Domain: "example.com", Host: "mx.example.com", Addr: "192.0.2.1:25"}
+	for _, outcome := range []struct {
+		result *DeliveryResult
+		err    error
+	}{
+		{ok, nil},
+		{ok, nil},
+		{failed, NewDeliveryError("example.com", "mx.example.com", StageStartTLS, ErrNoStartTLS)},
+	} {
+		session, recorded := NewTLSSession(SendOptions{STS: sts}, outcome.result, outcome.err, nil)
+		if !recorded {
+			t.Fatalf("session not recorded: %+v", outcome)
+		}
+		if err := store.Append(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := store.Load(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := BuildTLSReports("example org", "postmaster@example.org", start, end, sessions)
+	report, found := reports["example.com"]
+	if !found || len(report.Policies) != 1 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	policy := report.Policies[0]
+	if policy.Policy.PolicyType != TLSRPTPolicySTS || policy.Summary.Successful != 2 || policy.Summary.Failure != 1 {
+		t.Fatalf("unexpected policy summary: %+v", policy)
+	}
+	if len(policy.FailureDetails) != 1 || policy.FailureDetails[0].ResultType != TLSRPTStartTLSNotSupported {
+		t.Fatalf("unexpected failure details: %+v", policy.FailureDetails)
+	}
+
+	rua := ParseTLSRPTRecord([]string{"v=TLSRPTv1; rua=mailto:tlsrpt@example.com,https://example.com/tlsrpt"})
+	if len(rua) != 1 || rua[0] != "tlsrpt@example.com" {
+		t.Fatalf("unexpected rua: %v", rua)
+	}
+
+	msg, err := TLSReportMessage(report, "example.com", "postmaster@example.org", rua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || params["report-type"] != "tlsrpt" {
+		t.Fatalf("unexpected content type: %v", m.Header.Get("Content-Type"))
+	}
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	count := 0
+	for {
+		_, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 mime parts, got %d", count)
+	}
+
+	// sessions from after the pruned interval are kept, however far ahead.
+	later := TLSSession{Time: end.Add(48 * time.Hour), PolicyDomain: "example.com", PolicyType: TLSRPTPolicyNotFound}
+	if err := store.Append(later); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Prune(end); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ = store.Load(start, end); len(sessions) != 0 {
+		t.Fatal("sessions not pruned")
+	}
+	if sessions, _ = store.Load(end, later.Time.Add(time.Second)); len(sessions) != 1 {
+		t.Fatalf("expected the later session to be kept, found %d", len(sessions))
+	}
+}
+
+func TestTLSSessionOutcomes(t *testing.T) {
+	sts := &STSPolicy{Version: "STSv1", Mode: STSModeEnforce, MX: []string{"mx.example.com"}, MaxAge: 86400}
+	for _, tc := range []struct {
+		name   string
+		opts   SendOptions
+		result *DeliveryResult
+		err    error
+		want   string
+		record bool
+	}{
+		{"unreachable", SendOptions{TLS: TLSPolicy{Mode: TLSModeMay}},
+			&DeliveryResult{Domain: "example.com"},
+			NewDeliveryError("example.com", "", StageConnect, ErrNoServer), "", false},
+		{"unreachable with policy", SendOptions{STS: sts},
+			&DeliveryResult{Domain: "example.com"},
+			NewDeliveryError("example.com", "", StageConnect, ErrNoServer), "", false},
+		{"plaintext by policy", SendOptions{TLS: TLSPolicy{Mode: TLSModeNone}},
+			&DeliveryResult{Domain: "example.com", Host: "mx.example.com", Addr: "192.0.2.1:25"},
+			nil, "", false},
+		{"mx not permitted", SendOptions{STS: sts},
+			&DeliveryResult{Domain: "example.com"},
+			NewDeliveryError("example.com", "", StageConnect, ErrSTSNoMX), TLSRPTValidationFailure, true},
+		{"plaintext against policy", SendOptions{STS: sts},
+			&DeliveryResult{Domain: "example.com", Host: "mx.example.com", Addr: "192.0.2.1:25"},
+			nil, TLSRPTStartTLSNotSupported, true},
+		{"encrypted", SendOptions{},
+			&DeliveryResult{Domain: "example.com", Host: "mx.example.com", Addr: "192.0.2.1:25", Encrypted: true},
+			nil, "", true},
+	} {
+		session, recorded := NewTLSSession(tc.opts, tc.result, tc.err, nil)
+		if recorded != tc.record || session.ResultType != tc.want {
+			t.Errorf("%s: recorded %v with result %q", tc.name, recorded, session.ResultType)
+		}
+	}
+}
+
+func TestTLSSessionPruneConcurrent(t *testing.T) {
+	store := &TLSSessionStore{Path: path.Join(t.TempDir(), "tlsrpt.jsonl")}
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := store.Append(TLSSession{Time: now, PolicyDomain: "example.com"}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := store.Prune(now.Add(-time.Hour)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	sessions, err := store.Load(now, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 50 {
+		t.Fatalf("expected 50 sessions, found %d", len(sessions))
+	}
+}
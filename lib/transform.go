@@ -2,16 +2,13 @@ package lib
 
 import (
 	"bytes"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"crypto"
+	"fmt"
 	"log"
 	"net/mail"
 	"os/exec"
 	"strings"
 	"time"
-
-	dkim "github.com/willscott/go-dkim"
 )
 
 // RemoveHeader strips a single header from a byte array representing a full email
@@ -53,10 +50,7 @@ func RemoveHeader(msg *[]byte, header string) {
 // message IDs. The byte buffer of the message is modified in-place.
 func SanitizeMessage(parsed ParsedMessage, cfg *Config, forward bool) error {
 	// line endings.
-	if !bytes.Contains(*parsed.Bytes, []byte{13, 10, 13, 10}) {
-		// \n -> \r\n
-		*parsed.Bytes = bytes.Replace(*parsed.Bytes, []byte{10}, []byte{13, 10}, -1)
-	}
+	*parsed.Bytes = crlf(*parsed.Bytes)
 
 	if forward {
 		// Remove potentially-revealing headers.
@@ -94,99 +88,133 @@ func SanitizeMessage(parsed ParsedMessage, cfg *Config, forward bool) error {
 	return nil
 }
 
-// SignMessage takes a message byte buffer, and adds a DKIM signature to it
-// based on the configuration of the sending domain. the buffer is modified
-// in place.
-func SignMessage(parsed ParsedMessage, cfg *Config) error {
-	// Determine which subset of headers are included in the signature.
-	recommendedHeaders := []string{
-		"from", "sender", "reply-to", "subject", "date", "message-id", "to", "cc",
-		"mime-version", "content-type", "content-transfer-encoding", "content-id",
-		"content-description", "resent-date", "resent-from", "resent-sender", "resent-to",
-		"resent-cc", "resent-message-id", "in-reply-to", "references", "list-id", "list-help",
-		"list-unsubscribe", "list-subscribe", "list-post", "list-owner", "list-archive"}
-	recommendedSet := make(map[string]struct{}, len(recommendedHeaders))
-	for _, s := range recommendedHeaders {
-		recommendedSet[s] = struct{}{}
+// crlf converts a message with bare \n line endings to use \r\n.
+func crlf(msg []byte) []byte {
+	if bytes.Contains(msg, []byte{13, 10, 13, 10}) {
+		return msg
+	}
+	return bytes.Replace(msg, []byte{10}, []byte{13, 10}, -1)
+}
+
+// recommendedHeaders are the headers included in signatures when present,
+// unless `DkimHeaders` is configured.
+var recommendedHeaders = []string{
+	"from", "sender", "reply-to", "subject", "date", "message-id", "to", "cc",
+	"mime-version", "content-type", "content-transfer-encoding", "content-id",
+	"content-description", "resent-date", "resent-from", "resent-sender", "resent-to",
+	"resent-cc", "resent-message-id", "in-reply-to", "references", "list-id", "list-help",
+	"list-unsubscribe", "list-subscribe", "list-post", "list-owner", "list-archive"}
+
+// oversignedHeaders are the headers signed once more than they appear, unless
+// `DkimOversign` is configured.
+var oversignedHeaders = []string{"from", "to", "cc", "subject", "date", "reply-to", "message-id"}
+
+// signedHeaders determines the h= list of a signature over `fields`. Each
+// header to be signed is listed once for every time it appears, and those to
+// be oversigned once more, so that a verifier rejects any instance added
+// after signing.
+func signedHeaders(fields []headerField, cfg *Config) []string {
+	names := cfg.DkimHeaders
+	if len(names) == 0 {
+		names = recommendedHeaders
 	}
-	filteredHeaders := make([]string, 0)
-	for h, v := range parsed.Message.Header {
+	oversign := cfg.DkimOversign
+	if oversign == nil {
+		oversign = oversignedHeaders
+	}
+	extra := make(map[string]bool)
+	for _, h := range oversign {
+		extra[strings.ToLower(h)] = true
+	}
+
+	seen := make(map[string]bool)
+	out := make([]string, 0)
+	for _, h := range append(append([]string{}, names...), oversign...) {
 		hl := strings.ToLower(h)
-		if _, ok := recommendedSet[hl]; ok {
-			for i := 0; i < len(v); i++ {
-				filteredHeaders = append(filteredHeaders, hl)
+		if seen[hl] {
+			continue
+		}
+		seen[hl] = true
+		for _, f := range fields {
+			if strings.EqualFold(f.Name, hl) {
+				out = append(out, hl)
 			}
 		}
+		if extra[hl] {
+			out = append(out, hl)
+		}
 	}
+	return out
+}
 
-	// Load the key for signing.
-	keycmd := strings.Split(cfg.DkimKeyCmd, " ")
-	pkey, err := exec.Command(keycmd[0], keycmd[1:]...).Output()
+// PrepareMessage sanitizes a message and signs it with the DKIM keys of its
+// sending domain. A forwarded message is also sealed with ARC, recording the
+// status of the ARC chain and DKIM signatures it was received with, which are
+// checked against keys from the default resolver.
+func PrepareMessage(parsed ParsedMessage, cfg *Config, forward bool) error {
+	return (&ARCSealer{}).Prepare(parsed, cfg, forward)
+}
+
+// SignMessage takes a message byte buffer, and adds a DKIM signature to it
+// for each of the signing keys of the sending domain. the buffer is modified
+// in place. Each signature is verified against the public half of its key,
+// and an error returned if any does not verify.
+func SignMessage(parsed ParsedMessage, cfg *Config) error {
+	fields, body, err := splitMessage(*parsed.Bytes)
 	if err != nil {
-		log.Fatalf("Could not retreive DKIM key: %v\n", err)
+		return err
 	}
+	// Determine which subset of headers are included in the signature.
+	headers := signedHeaders(fields, cfg)
 
-	// figure out what type of key it is
-	kb, _ := pem.Decode(pkey)
-	if kb == nil {
-		log.Fatal("Could not decode DKIM key")
-	}
-	pk, err := x509.ParsePKCS8PrivateKey(kb.Bytes)
-	if err != nil {
-		rpk, err := x509.ParsePKCS1PrivateKey(kb.Bytes)
-		if err == nil {
-			pk = rpk
-		} else {
-			log.Fatalf("Could not parse DKIM key: %v\n", err)
+	pubs := make(map[string]crypto.PublicKey)
+	for _, key := range cfg.SigningKeys() {
+		signer, algo, err := dkimSigner(key.KeyCmd)
+		if err != nil {
+			return err
+		}
+
+		selector := "default"
+		if key.Selector != "" {
+			selector = key.Selector
 		}
-	}
-	algo := "rsa-sha256"
-	if _, ok := pk.(*rsa.PrivateKey); !ok {
-		algo = "ed25519-sha256"
-	}
 
-	selector := "default"
-	if cfg.DkimSelector != "" {
-		selector = cfg.DkimSelector
+		// Sign.
+		tags := []string{"v=1", "a=" + algo, "c=relaxed/relaxed", "d=" + parsed.SourceDomain,
+			"s=" + selector, "h=" + strings.Join(headers, ":"), "bh=" + bodyHash(body, true, -1)}
+		sig, err := signField("DKIM-Signature", tags, selectHeaders(fields, headers), signer)
+		if err != nil {
+			return fmt.Errorf("signing with selector %s: %w", selector, err)
+		}
+		*parsed.Bytes = append([]byte(sig.Raw), *parsed.Bytes...)
+		pubs[selector] = signer.Public()
 	}
 
-	// Sign.
-	options := dkim.NewSigOptions()
-	options.Algo = algo
-	options.PrivateKey = pkey
-	options.Domain = parsed.SourceDomain
-	options.Selector = selector
-	options.SignatureExpireIn = 0
-	options.Headers = filteredHeaders
-	options.AddSignatureTimestamp = false
-	options.Canonicalization = "relaxed/relaxed"
-
-	return dkim.Sign(parsed.Bytes, options)
+	// Check the signatures against the keys that made them before they are
+	// relied on.
+	return verifySigned(*parsed.Bytes, parsed.SourceDomain, pubs)
 }
 
-/*
-func SealMessage(parsed ParsedMessage, cfg *Config) error {
-	instanceID := extractInstanceID(parsed.Message.Header)
-	header := "ARC-Authentication-Results: i=" + strconv.Itoa(instanceID+1) + "; " +
+// dkimSigner returns a signer for the key output by a key command. When a key
+// agent is configured the key is held, and signatures made, by the agent.
+func dkimSigner(keyCmd string) (crypto.Signer, string, error) {
+	if KeyAgent != nil {
+		return KeyAgent.Signer(keyCmd)
+	}
+	pkey, err := loadDkimKey(keyCmd)
+	if err != nil {
+		return nil, "", err
+	}
+	return ParseDkimKey(pkey)
 }
 
-// extract the ARC instance number from the message header.
-func extractInstanceID(header mail.Header) int {
-	maxI := 0
-	for _, v := range header["ARC-Seal"] {
-		parts := strings.Split(v, ";")
-		for _, p := range parts {
-			if strings.HasPrefix(p, "i=") {
-				i := strings.TrimPrefix(p, "i=")
-				if i == "" {
-					continue
-				}
-				if iInt, err := strconv.Atoi(i); err == nil && iInt > maxI {
-					maxI = iInt
-				}
-			}
-		}
+// loadDkimKey runs a key command, returning the PEM encoded private key it
+// outputs.
+func loadDkimKey(cmdLine string) ([]byte, error) {
+	keycmd := strings.Split(cmdLine, " ")
+	pkey, err := exec.Command(keycmd[0], keycmd[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve DKIM key: %w", err)
 	}
-	return maxI
+	return pkey, nil
 }
-*/
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// writeRSAKey writes a new PEM encoded RSA key into dir, returning a command
+// which outputs it.
+func writeRSAKey(t *testing.T, dir, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeKey(t, dir, name, key)
+}
+
+// writeKey writes a PEM encoded private key into dir, returning a command
+// which outputs it.
+func writeKey(t *testing.T, dir, name string, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := path.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "cat " + file
+}
+
+func TestSignMessageKeys(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("example.com", map[string]interface{}{
+		"dkimkeycmd":   writeRSAKey(t, dir, "a.pem"),
+		"dkimselector": "a",
+		"dkimkeys": []interface{}{
+			map[string]interface{}{"KeyCmd": writeRSAKey(t, dir, "b.pem"), "Selector": "b"},
+		},
+	})
+	defer viper.Reset()
+	cfg := GetConfig("example.com")
+	keys := cfg.SigningKeys()
+	if len(keys) != 2 || keys[0].Selector != "a" || keys[1].Selector != "b" {
+		t.Fatalf("unexpected signing keys %v", keys)
+	}
+
+	content := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nSubject: hi\r\n\r\nbody\r\n")
+	msg := ParseMessage(&content)
+	if err := SignMessage(msg, cfg); err != nil {
+		t.Fatal(err)
+	}
+	signed := string(*msg.Bytes)
+	if n := strings.Count(signed, "DKIM-Signature:"); n != 2 {
+		t.Fatalf("expected 2 signatures, found %d:\n%s", n, signed)
+	}
+	for _, sel := range []string{"s=a;", "s=b;"} {
+		if !strings.Contains(signed, sel) {
+			t.Fatalf("no signature with %s:\n%s", sel, signed)
+		}
+	}
+
+	// a failing key command is an error rather than fatal.
+	cfg.DkimKeys = append(cfg.DkimKeys, DkimKey{KeyCmd: "false"})
+	if err := SignMessage(msg, cfg); err == nil {
+		t.Fatal("expected an error for a failing key command")
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	msg := []byte("From: alice@example.com\r\nTo: bob@example.org\r\nReceived: x\r\nReceived: y\r\nSubject: hi\r\n\r\nbody\r\n")
+	fields, _, err := splitMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(signedHeaders(fields, &Config{}), ":")
+	if got != "from:from:reply-to:subject:subject:date:message-id:to:to:cc" {
+		t.Fatalf("unexpected default headers %s", got)
+	}
+	cfg := &Config{DkimHeaders: []string{"From", "Received"}, DkimOversign: []string{}}
+	if got = strings.Join(signedHeaders(fields, cfg), ":"); got != "from:received:received" {
+		t.Fatalf("unexpected configured headers %s", got)
+	}
+
+	// an oversigned header added after signing breaks the signature.
+	dir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signCfg := &Config{DkimKeyCmd: writeKey(t, dir, "key.pem", key), DkimSelector: "sel"}
+	parsed := ParseMessage(&msg)
+	if err := SignMessage(parsed, signCfg); err != nil {
+		t.Fatal(err)
+	}
+	pubs := func() map[string]crypto.PublicKey { return map[string]crypto.PublicKey{"sel": key.Public()} }
+	added := append([]byte("Subject: urgent\r\n"), *parsed.Bytes...)
+	if err := verifySigned(added, "example.com", pubs()); err == nil {
+		t.Fatal("signature verified with an added subject")
+	}
+	if err := verifySigned(*parsed.Bytes, "example.com", pubs()); err != nil {
+		t.Fatal(err)
+	}
+}